@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+)
+
+const apiPrefix = "/api/v1"
+
+// registerApi adds the per-subsystem routes, each of them serves its part of the latest sample.
+func registerApi(mux *http.ServeMux, h *handler) {
+	mux.HandleFunc(apiPrefix+"/cpu", h.serveCpu)
+	mux.HandleFunc(apiPrefix+"/memory", h.serveMemory)
+	mux.HandleFunc(apiPrefix+"/network", h.serveNetwork)
+	mux.HandleFunc(apiPrefix+"/disks/{pool}", h.servePool)
+	mux.HandleFunc(apiPrefix+"/array/state", h.serveArrayState)
+	mux.HandleFunc(apiPrefix+"/pools", h.servePools)
+	mux.HandleFunc(apiPrefix+"/pools/{pool}", h.servePool)
+	mux.HandleFunc(apiPrefix+"/parity", h.serveParity)
+	mux.HandleFunc(apiPrefix+"/parity/check", h.serveParityCheck)
+	mux.HandleFunc(apiPrefix+"/zfs", h.serveZfs)
+	mux.HandleFunc(apiPrefix+"/shares", h.serveShares)
+	mux.HandleFunc(apiPrefix+"/history", h.serveHistory)
+	mux.HandleFunc(apiPrefix+"/export", h.serveExport)
+	mux.HandleFunc(apiPrefix+"/alerts", h.serveAlerts)
+	mux.HandleFunc(apiPrefix+"/stream", h.serveEvents)
+	mux.HandleFunc(apiPrefix+"/ws", h.serveWebSocket)
+	mux.HandleFunc("/health", h.serveHealth)
+}
+
+// serveHealth is always reachable without credentials, it only tells whether a sample has been taken yet,
+// answering right away rather than keeping health checks waiting for the first one
+func (h *handler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	sample, ok := h.Sampler.Latest()
+	if !ok {
+		h.writeJson(w, http.StatusServiceUnavailable, map[string]any{"status": "starting"})
+		return
+	}
+	h.writeJson(w, http.StatusOK, map[string]any{"status": "ok", "sampled_at": sample.SampledAt})
+}
+
+func (h *handler) serveCpu(w http.ResponseWriter, r *http.Request) {
+	sample, ok := h.sample(r)
+	if !ok {
+		return
+	}
+	filter := h.filter(r)
+	needed := filter.Needs("cpu") || filter.Needs("cores")
+	h.writeFilteredJson(w, r, report.CpuReport{Cpu: sample.Cpu, Cores: sample.Cores}, needed)
+}
+
+func (h *handler) serveMemory(w http.ResponseWriter, r *http.Request) {
+	sample, ok := h.sample(r)
+	if !ok {
+		return
+	}
+	h.writeFilteredJson(w, r, sample.Memory, h.filter(r).Needs("memory"), "memory")
+}
+
+func (h *handler) serveNetwork(w http.ResponseWriter, r *http.Request) {
+	sample, ok := h.sample(r)
+	if !ok {
+		return
+	}
+	filter := h.filter(r)
+	needed := filter.Needs("network") || filter.Needs("network_total")
+	h.writeFilteredJson(w, r, report.NetworkReport{
+		Network:      sample.Network,
+		NetworkTotal: sample.NetworkTotal,
+	}, needed)
+}
+
+func (h *handler) servePools(w http.ResponseWriter, r *http.Request) {
+	sample, ok := h.sample(r)
+	if !ok {
+		return
+	}
+	h.writeFilteredJson(w, r, sample.Pools, h.filter(r).Needs("pools"), "pools")
+}
+
+func (h *handler) servePool(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("pool")
+	filter := h.filter(r)
+	sample, ok := h.sample(r)
+	if !ok {
+		return
+	}
+	status, found := sample.Pool(name)
+	if !found {
+		h.writeJson(w, http.StatusNotFound, report.ErrorResponse{
+			Error: fmt.Sprintf("pool %s is not configured", name),
+		})
+		return
+	}
+
+	if name != "array" && name != "cache" {
+		h.writeFilteredJson(w, r, status, filter.Needs("pools", name), "pools", name)
+		return
+	}
+
+	// the array and the cache are filtered by their place in the report, e.g. "array" and "array_total"
+	if !filter.Needs(name) && !filter.Needs(name+"_total") {
+		h.writeJson(w, http.StatusNotFound, report.ErrorResponse{Error: "excluded by the configuration"})
+		return
+	}
+	disks, errDisks := filter.Apply(status.Disks, name)
+	total, errTotal := filter.Apply(status.Total, name+"_total")
+	if err := errors.Join(errDisks, errTotal); err != nil {
+		h.writeJson(w, http.StatusInternalServerError, report.ErrorResponse{Error: err.Error()})
+		return
+	}
+	response := map[string]any{"name": name, "total": total, "disks": disks}
+	if status.Btrfs != nil && filter.Needs(name+"_btrfs") {
+		btrfs, err := filter.Apply(status.Btrfs, name+"_btrfs")
+		if err != nil {
+			h.writeJson(w, http.StatusInternalServerError, report.ErrorResponse{Error: err.Error()})
+			return
+		}
+		response["btrfs"] = btrfs
+	}
+	h.writeJson(w, http.StatusOK, response)
+}
+
+func (h *handler) serveParity(w http.ResponseWriter, r *http.Request) {
+	sample, ok := h.sample(r)
+	if !ok {
+		return
+	}
+	h.writeFilteredJson(w, r, sample.Parity, h.filter(r).Needs("parity"), "parity")
+}
+
+func (h *handler) serveArrayState(w http.ResponseWriter, r *http.Request) {
+	sample, ok := h.sample(r)
+	if !ok {
+		return
+	}
+	h.writeFilteredJson(w, r, sample.ArrayState, h.filter(r).Needs("array_state"), "array_state")
+}
+
+func (h *handler) serveZfs(w http.ResponseWriter, r *http.Request) {
+	sample, ok := h.sample(r)
+	if !ok {
+		return
+	}
+	h.writeFilteredJson(w, r, sample.Zfs, h.filter(r).Needs("zfs"), "zfs")
+}
+
+func (h *handler) serveShares(w http.ResponseWriter, r *http.Request) {
+	sample, ok := h.sample(r)
+	if !ok {
+		return
+	}
+	h.writeFilteredJson(w, r, sample.Shares, h.filter(r).Needs("shares"), "shares")
+}
+
+func (h *handler) serveParityCheck(w http.ResponseWriter, r *http.Request) {
+	sample, ok := h.sample(r)
+	if !ok {
+		return
+	}
+	h.writeFilteredJson(w, r, sample.ParityCheck, h.filter(r).Needs("parity_check"), "parity_check")
+}
+
+// serveAlerts also returns the pending and recently resolved alerts, which are not part of the report
+func (h *handler) serveAlerts(w http.ResponseWriter, r *http.Request) {
+	filter := h.filter(r)
+	if !filter.Needs("alerts") {
+		h.writeJson(w, http.StatusNotFound, report.ErrorResponse{Error: "excluded by the configuration"})
+		return
+	}
+	h.writeJson(w, http.StatusOK, h.Sampler.Alerts().Report().Allowed(filter))
+}
+
+const defaultHistoryRange = time.Hour
+
+func (h *handler) serveHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	metric := query.Get("metric")
+	if metric == "" {
+		h.writeJson(w, http.StatusBadRequest, report.ErrorResponse{Error: "metric is required, e.g. metric=cpu.load_percent"})
+		return
+	}
+
+	now := time.Now()
+	to, errTo := parseHistoryTime(query.Get("to"), now, now)
+	from, errFrom := parseHistoryTime(query.Get("from"), to.Add(-defaultHistoryRange), now)
+	var step time.Duration
+	var errStep error
+	if query.Get("step") != "" {
+		step, errStep = parseHistoryDuration(query.Get("step"))
+	}
+	if err := errors.Join(errFrom, errTo, errStep); err != nil {
+		h.writeJson(w, http.StatusBadRequest, report.ErrorResponse{Error: err.Error()})
+		return
+	}
+	if from.After(to) {
+		h.writeJson(w, http.StatusBadRequest, report.ErrorResponse{Error: "from must be before to"})
+		return
+	}
+
+	history := h.Sampler.History()
+	if history == nil || !h.filter(r).Allows(strings.Split(metric, ".")...) {
+		h.writeJson(w, http.StatusNotFound, report.ErrorResponse{Error: fmt.Sprintf("no history for metric %s", metric)})
+		return
+	}
+	result, err := history.Query(metric, from, to, step, now)
+	if err != nil {
+		h.writeJson(w, http.StatusNotFound, report.ErrorResponse{Error: fmt.Sprintf("no history for metric %s", metric)})
+		return
+	}
+	h.writeJson(w, http.StatusOK, result)
+}
+
+// serveExport exports the stored series like the export command, which cannot open the database while the API has it open
+func (h *handler) serveExport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = report.ExportCsv
+	}
+	if format != report.ExportCsv && format != report.ExportJson {
+		h.writeJson(w, http.StatusBadRequest, report.ErrorResponse{Error: fmt.Sprintf("unknown format %s, expected %s or %s", format, report.ExportCsv, report.ExportJson)})
+		return
+	}
+	now := time.Now()
+	from, errFrom := parseHistoryTime(query.Get("from"), time.Unix(0, 0), now)
+	to, errTo := parseHistoryTime(query.Get("to"), now, now)
+	if err := errors.Join(errFrom, errTo); err != nil {
+		h.writeJson(w, http.StatusBadRequest, report.ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	history := h.Sampler.History()
+	if history == nil || history.Storage() == nil {
+		h.writeJson(w, http.StatusNotFound, report.ErrorResponse{Error: "storage is not configured"})
+		return
+	}
+
+	if format == report.ExportJson {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/csv")
+	}
+	h.setCorsHeaders(w)
+	if err := history.Storage().Export(w, format, query.Get("metric"), from, to, h.filter(r)); err != nil {
+		slog.Error("Unable to export", slog.String("error", err.Error()))
+		h.writeJson(w, http.StatusInternalServerError, report.ErrorResponse{Error: err.Error()})
+	}
+}
+
+// parseHistoryTime accepts RFC 3339 times, Unix timestamps in seconds, and durations relative to now such as "-1h"
+func parseHistoryTime(value string, fallback time.Time, now time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+	if relative, err := time.ParseDuration(value); err == nil {
+		return now.Add(relative), nil
+	}
+	return fallback, fmt.Errorf("unable to parse time %s", value)
+}
+
+func parseHistoryDuration(value string) (time.Duration, error) {
+	if duration, err := time.ParseDuration(value); err == nil && duration > 0 {
+		return duration, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return 0, fmt.Errorf("unable to parse step %s", value)
+}
+
+// writeFilteredJson responds with the value filtered as configured and as the request's scope allows, the prefix being its path within the report.
+// If needed is false the whole value has been excluded, and the response is a 404.
+func (h *handler) writeFilteredJson(w http.ResponseWriter, r *http.Request, response any, needed bool, prefix ...string) {
+	if !needed {
+		h.writeJson(w, http.StatusNotFound, report.ErrorResponse{Error: "excluded by the configuration"})
+		return
+	}
+
+	filtered, err := h.filter(r).Apply(response, prefix...)
+	if err != nil {
+		h.writeJson(w, http.StatusInternalServerError, report.ErrorResponse{Error: err.Error()})
+		return
+	}
+	h.writeJson(w, http.StatusOK, filtered)
+}
+
+func (h *handler) writeJson(w http.ResponseWriter, statusCode int, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	h.setCorsHeaders(w)
+
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("Error trying to respond to API call",
+			slog.String("error", err.Error()),
+			slog.String("attempting to marshal", fmt.Sprintf("%+v\n", response)))
+		errorResponse, _ := json.Marshal(report.ErrorResponse{Error: err.Error()})
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(errorResponse)
+		return
+	}
+
+	slog.Debug("Responding to request", "response", responseJson)
+	w.WriteHeader(statusCode)
+	w.Write(responseJson)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const authRealm = "unraid-simple-monitoring-api"
+
+// compared against when the user is unknown, so that unknown users take as long to be refused as wrong passwords
+var unknownUserHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+	return hash
+})
+
+// paths anyone may call, e.g. container health checks
+var unauthenticatedPaths = map[string]bool{"/health": true}
+
+// scopeKey holds the report.Filter of the request's credentials in its context
+type scopeKey struct{}
+
+type credential struct {
+	name   string
+	secret []byte
+	scope  report.Filter
+}
+
+// authenticator only lets through the requests presenting a configured bearer token or basic auth user,
+// each with the scope they have been given
+type authenticator struct {
+	tokens []credential
+	users  map[string]credential
+	cors   *conf.Cors
+}
+
+func newAuthenticator(configuration conf.Auth, cors *conf.Cors) (*authenticator, error) {
+	auth := &authenticator{users: make(map[string]credential), cors: cors}
+	for i, token := range configuration.Tokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("auth token %d (%s) has no token", i+1, token.Name)
+		}
+		name := token.Name
+		if name == "" {
+			name = fmt.Sprintf("token %d", i+1)
+		}
+		auth.tokens = append(auth.tokens, credential{name: name, secret: []byte(token.Token), scope: report.NewFilter(token.Scopes, token.Exclude)})
+	}
+	for _, user := range configuration.Users {
+		if _, err := bcrypt.Cost([]byte(user.Password)); err != nil {
+			return nil, fmt.Errorf("password of auth user %s is not a bcrypt hash: %w", user.Username, err)
+		}
+		auth.users[user.Username] = credential{name: user.Username, secret: []byte(user.Password), scope: report.NewFilter(user.Scopes, user.Exclude)}
+	}
+	return auth, nil
+}
+
+// authenticate returns the credential presented by the request, if it is a valid one
+func (auth *authenticator) authenticate(r *http.Request) (credential, bool) {
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		// every token is compared, so the time taken does not tell which one came close
+		var matched credential
+		ok := false
+		for _, candidate := range auth.tokens {
+			if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), candidate.secret) == 1 {
+				matched, ok = candidate, true
+			}
+		}
+		return matched, ok
+	}
+
+	username, password, found := r.BasicAuth()
+	if !found || len(auth.users) == 0 {
+		return credential{}, false
+	}
+	user, known := auth.users[username]
+	if !known {
+		bcrypt.CompareHashAndPassword(unknownUserHash(), []byte(password))
+		return credential{}, false
+	}
+	if bcrypt.CompareHashAndPassword(user.secret, []byte(password)) != nil {
+		return credential{}, false
+	}
+	return user, true
+}
+
+// wrap refuses the requests without valid credentials, and passes the scope of the others on through their context.
+// CORS preflight requests are answered directly, browsers sending them without credentials.
+func (auth *authenticator) wrap(next http.Handler, h *handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticatedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodOptions && auth.cors != nil {
+			h.setCorsHeaders(w)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		presented, ok := auth.authenticate(r)
+		if !ok {
+			slog.Debug("Request refused, missing or invalid credentials", "remote", r.RemoteAddr, "path", r.URL.Path)
+			if len(auth.tokens) > 0 {
+				w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, authRealm))
+			}
+			if len(auth.users) > 0 {
+				w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, authRealm))
+			}
+			h.writeJson(w, http.StatusUnauthorized, report.ErrorResponse{Error: "missing or invalid credentials"})
+			return
+		}
+
+		slog.Debug("Request authenticated", "as", presented.name, "path", r.URL.Path)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), scopeKey{}, presented.scope)))
+	})
+}
+
+// filter is the configured filter, restricted to the scope of the request's credentials
+func (h *handler) filter(r *http.Request) report.Filter {
+	if scope, ok := r.Context().Value(scopeKey{}).(report.Filter); ok {
+		return h.Filter.Within(scope)
+	}
+	return h.Filter
+}
+
+// runHashPassword prints the bcrypt hash of the password read from the standard input, for auth users.
+// It returns the exit code.
+func runHashPassword() int {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "Unable to read password:", err)
+		return 1
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to hash password:", err)
+		return 1
+	}
+	fmt.Println(string(hash))
+	return 0
+}
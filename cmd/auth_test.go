@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testToken = "s3cr3t-token"
+const testPassword = "correct horse"
+
+// testAuth serves the root, metrics and API routes behind a token with every scope,
+// tokens restricted to parts of the report and a basic auth user
+func testAuth(t *testing.T, h *handler, cors *conf.Cors) http.Handler {
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := newAuthenticator(conf.Auth{
+		Tokens: []conf.AuthToken{
+			{Name: "full", Token: testToken},
+			{Name: "memory", Token: "memory-token", AuthScope: conf.AuthScope{Scopes: []string{"memory"}}},
+			{Name: "alerts", Token: "alerts-token", AuthScope: conf.AuthScope{Scopes: []string{"memory", "alerts"}}},
+			{Name: "public", Token: "public-token", AuthScope: conf.AuthScope{Exclude: []string{"array.*.disk_id"}}},
+		},
+		Users: []conf.AuthUser{{Username: "admin", Password: string(hash)}},
+	}, cors)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", h)
+	mux.HandleFunc("/metrics", h.ServeMetrics)
+	registerApi(mux, h)
+	return auth.wrap(mux, h)
+}
+
+func TestAuthenticate(t *testing.T) {
+	server := testAuth(t, testHandler(t, conf.Conf{}), nil)
+
+	cases := []struct {
+		name      string
+		authorize func(r *http.Request)
+		status    int
+	}{
+		{"no credentials", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"valid token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+testToken) }, http.StatusOK},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer not-the-token") }, http.StatusUnauthorized},
+		{"valid password", func(r *http.Request) { r.SetBasicAuth("admin", testPassword) }, http.StatusOK},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{"unknown user", func(r *http.Request) { r.SetBasicAuth("nobody", testPassword) }, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			c.authorize(r)
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, r)
+			if w.Code != c.status {
+				t.Fatalf("expected %d, got %d: %s", c.status, w.Code, w.Body)
+			}
+			if c.status != http.StatusUnauthorized {
+				return
+			}
+			challenges := w.Header().Values("WWW-Authenticate")
+			if len(challenges) != 2 || !strings.HasPrefix(challenges[0], "Bearer realm=") || !strings.HasPrefix(challenges[1], "Basic realm=") {
+				t.Fatalf("expected a bearer and a basic challenge, got %v", challenges)
+			}
+		})
+	}
+}
+
+func TestAuthRejectsPlainPassword(t *testing.T) {
+	_, err := newAuthenticator(conf.Auth{Users: []conf.AuthUser{{Username: "admin", Password: testPassword}}}, nil)
+	if err == nil {
+		t.Fatal("expected a password that is not a bcrypt hash to be refused")
+	}
+}
+
+func TestAuthHealth(t *testing.T) {
+	// never run, no sample is ever taken
+	sampler := report.NewSampler(&report.Collector{}, nil, time.Hour)
+	h := NewHandler(conf.Conf{}, sampler)
+	w := httptest.NewRecorder()
+	testAuth(t, &h, nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"starting"`) {
+		t.Fatalf("expected 503 starting before the first sample, got %d: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	testAuth(t, testHandler(t, conf.Conf{}), nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"ok"`) {
+		t.Fatalf("expected 200 ok without credentials, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAuthPreflight(t *testing.T) {
+	h := testHandler(t, conf.Conf{})
+	cases := []struct {
+		name   string
+		cors   *conf.Cors
+		status int
+	}{
+		{"with cors", &conf.Cors{Origin: "*", Methods: "GET", Headers: "Authorization"}, http.StatusNoContent},
+		{"without cors", nil, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h.Cors = c.cors
+			w := httptest.NewRecorder()
+			testAuth(t, h, c.cors).ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/", nil))
+			if w.Code != c.status {
+				t.Fatalf("expected %d, got %d", c.status, w.Code)
+			}
+			if c.cors != nil && w.Header().Get("Access-Control-Allow-Origin") != "*" {
+				t.Fatalf("expected the CORS headers, got %v", w.Header())
+			}
+		})
+	}
+}
+
+// getWithToken returns the body of a successful response
+func getWithToken(t *testing.T, server http.Handler, path string, token string) string {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: expected 200, got %d: %s", path, w.Code, w.Body)
+	}
+	return w.Body.String()
+}
+
+func TestAuthScope(t *testing.T) {
+	server := testAuth(t, testHandler(t, conf.Conf{}), nil)
+	get := func(path string, token string) string { return getWithToken(t, server, path, token) }
+
+	for _, c := range []struct {
+		token  string
+		others bool
+	}{{testToken, true}, {"memory-token", false}} {
+		var root map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(get("/", c.token)), &root); err != nil {
+			t.Fatal(err)
+		}
+		if _, found := root["memory"]; !found {
+			t.Errorf("%s: expected the memory in %v", c.token, root)
+		}
+		if _, found := root["network_total"]; found != c.others {
+			t.Errorf("%s: expected the network total %v in %v", c.token, c.others, root)
+		}
+
+		metrics := get("/metrics", c.token)
+		if !strings.Contains(metrics, "unraid_memory_") {
+			t.Errorf("%s: expected memory metrics in\n%s", c.token, metrics)
+		}
+		if strings.Contains(metrics, "unraid_cpu_") != c.others {
+			t.Errorf("%s: expected CPU metrics %v in\n%s", c.token, c.others, metrics)
+		}
+	}
+
+	t.Run("disks", testAuthScopeDisks)
+}
+
+// testDiskHandler serves a single array disk at 45°C, above the threshold of an alert on its temperature
+func testDiskHandler(t *testing.T) *handler {
+	prefix := t.TempDir()
+	emhttp := filepath.Join(prefix, "var", "local", "emhttp")
+	for _, dir := range []string{emhttp, filepath.Join(prefix, "mnt", "disk1")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	disksIni := "[\"disk1\"]\nid=\"WDC_WD80_SERIAL\"\ntemp=\"45\"\nspundown=\"0\"\nstatus=\"DISK_OK\"\n"
+	if err := os.WriteFile(filepath.Join(emhttp, "disks.ini"), []byte(disksIni), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOSTFS_PREFIX", prefix)
+
+	configuration := conf.Conf{
+		Include:  []string{"array", "memory", "alerts"},
+		Disks:    map[string][]string{"array": {"/mnt/disk1"}},
+		Units:    conf.Units{Array: "Gi", Cache: "Gi", Pools: "Gi", Memory: "Mi"},
+		Alerts:   []conf.AlertRule{{Name: "disk_hot", Expr: "array.disk1.temp > 40", Severity: "warning"}},
+		Forecast: conf.Forecast{Path: filepath.Join(prefix, "forecast.json"), Window: time.Hour},
+	}
+	return testCollectorHandler(t, configuration, report.NewCollector(configuration))
+}
+
+func testAuthScopeDisks(t *testing.T) {
+	server := testAuth(t, testDiskHandler(t), nil)
+	get := func(path string, token string) string { return getWithToken(t, server, path, token) }
+
+	// the alert reveals the disk's path and temperature, it is only shown to who may read them
+	for _, c := range []struct {
+		token   string
+		visible bool
+	}{{testToken, true}, {"alerts-token", false}} {
+		var alerts report.AlertsReport
+		if err := json.Unmarshal([]byte(get("/api/v1/alerts", c.token)), &alerts); err != nil {
+			t.Fatal(err)
+		}
+		if (len(alerts.Active) == 1) != c.visible {
+			t.Errorf("%s: expected the disk alert %v, got %+v", c.token, c.visible, alerts)
+		}
+		if strings.Contains(get("/", c.token), "array.disk1.temp") != c.visible {
+			t.Errorf("%s: expected the disk alert in the report %v", c.token, c.visible)
+		}
+	}
+
+	// a token kept from the disk ids sees the disks without their serial numbers
+	for _, c := range []struct {
+		token   string
+		visible bool
+	}{{testToken, true}, {"public-token", false}} {
+		metrics := get("/metrics", c.token)
+		if !strings.Contains(metrics, "unraid_disk_temp_celsius{") {
+			t.Errorf("%s: expected disk metrics in\n%s", c.token, metrics)
+		}
+		if strings.Contains(metrics, "WDC_WD80_SERIAL") != c.visible {
+			t.Errorf("%s: expected the disk id %v in\n%s", c.token, c.visible, metrics)
+		}
+		if strings.Contains(get("/", c.token), "WDC_WD80_SERIAL") != c.visible {
+			t.Errorf("%s: expected the disk id in the report %v", c.token, c.visible)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+)
+
+// runExport dumps the stored metrics, the database being the configured storage unless given with -db.
+// It returns the exit code.
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	dbPath := flags.String("db", "", "path of the database, defaults to the configured storage path")
+	format := flags.String("format", report.ExportCsv, "csv or json")
+	metric := flags.String("metric", "", "only export this metric, e.g. cpu.load_percent")
+	fromValue := flags.String("from", "", "only export points from this time, RFC 3339, Unix timestamp or relative such as -24h")
+	toValue := flags.String("to", "", "only export points up to this time")
+	output := flags.String("output", "", "file to write to, defaults to the standard output")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *dbPath == "" {
+		configuration, err := conf.ReadConf(os.Getenv("CONF_PATH"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to read configuration file:", err)
+			return 1
+		}
+		if configuration.Storage == nil {
+			fmt.Fprintln(os.Stderr, "Storage is not configured, add a storage section to the configuration file or use -db")
+			return 1
+		}
+		*dbPath = configuration.Storage.Path
+	}
+
+	now := time.Now()
+	from, err := parseHistoryTime(*fromValue, time.Unix(0, 0), now)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	to, err := parseHistoryTime(*toValue, now, now)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to create output file:", err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if err := report.Export(w, *dbPath, *format, *metric, from, to); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to export:", err)
+		if errors.Is(err, report.ErrStorageInUse) {
+			fmt.Fprintln(os.Stderr, "While the API is running, export through its "+apiPrefix+"/export endpoint instead")
+		}
+		return 1
+	}
+	return 0
+}
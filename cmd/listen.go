@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const unixPrefix = "unix:"
+
+// listen opens every address, "unix:/path" ones being Unix domain sockets and bare ports such as "8080" listening on all interfaces.
+// The sockets are given socketMode, an octal mode such as "0660", when set.
+// The listeners already opened are closed if one of them cannot be.
+func listen(addresses []string, socketMode string) ([]net.Listener, error) {
+	var mode fs.FileMode
+	if socketMode != "" {
+		parsed, err := strconv.ParseUint(socketMode, 8, 32)
+		if err != nil || parsed > uint64(fs.ModePerm) {
+			return nil, fmt.Errorf("invalid socket mode %s, expected an octal mode such as 0660", socketMode)
+		}
+		mode = fs.FileMode(parsed)
+	}
+
+	var listeners []net.Listener
+	for _, address := range addresses {
+		listener, err := listenOn(strings.TrimSpace(address), mode)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("unable to listen on %s: %w", address, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listenOn opens the address, a Unix domain socket being given the mode unless it is 0
+func listenOn(address string, mode fs.FileMode) (net.Listener, error) {
+	if path, found := strings.CutPrefix(address, unixPrefix); found {
+		// a socket left behind by a previous run that was not shut down cleanly would prevent listening
+		if info, err := os.Lstat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		listener, err := net.Listen("unix", path)
+		if err != nil || mode == 0 {
+			return listener, err
+		}
+		// the socket is created with the umask applied, which usually keeps other users from connecting
+		if err := os.Chmod(path, mode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+
+	if !strings.Contains(address, ":") {
+		if _, err := strconv.ParseUint(address, 10, 16); err != nil {
+			return nil, errors.New(`expected a port such as "8080", a host and port such as "127.0.0.1:8080" or a socket such as "unix:/app/api.sock"`)
+		}
+		address = ":" + address
+	}
+	return net.Listen("tcp", address)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// staleSocket leaves a socket file behind, as a process that was not shut down cleanly would
+func staleSocket(t *testing.T, path string) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+}
+
+// freePort returns a port nothing listens on
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestListenOn(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "api.sock")
+	staleSocketPath := filepath.Join(dir, "stale.sock")
+	regularFile := filepath.Join(dir, "not-a-socket")
+	port := freePort(t)
+
+	cases := []struct {
+		name    string
+		address string
+		setup   func(t *testing.T)
+		check   func(t *testing.T, address net.Addr)
+		fails   bool
+	}{
+		{
+			name:    "bare port",
+			address: strconv.Itoa(port),
+			check: func(t *testing.T, address net.Addr) {
+				if tcp, ok := address.(*net.TCPAddr); !ok || !tcp.IP.IsUnspecified() || tcp.Port != port {
+					t.Fatalf("expected port %d on all interfaces, got %v", port, address)
+				}
+			},
+		},
+		{
+			name:    "host and port",
+			address: "127.0.0.1:0",
+			check: func(t *testing.T, address net.Addr) {
+				if tcp, ok := address.(*net.TCPAddr); !ok || !tcp.IP.IsLoopback() {
+					t.Fatalf("expected the loopback interface, got %v", address)
+				}
+			},
+		},
+		{
+			name:    "unix socket",
+			address: unixPrefix + socket,
+			check: func(t *testing.T, address net.Addr) {
+				if address.Network() != "unix" || address.String() != socket {
+					t.Fatalf("expected %s, got %v", socket, address)
+				}
+			},
+		},
+		{
+			name:    "stale unix socket",
+			address: unixPrefix + staleSocketPath,
+			setup:   func(t *testing.T) { staleSocket(t, staleSocketPath) },
+			check: func(t *testing.T, address net.Addr) {
+				if address.Network() != "unix" || address.String() != staleSocketPath {
+					t.Fatalf("expected %s, got %v", staleSocketPath, address)
+				}
+			},
+		},
+		{
+			name:    "host without a port",
+			address: "localhost",
+			check:   func(t *testing.T, address net.Addr) {},
+			fails:   true,
+		},
+		{
+			name:    "not a socket",
+			address: unixPrefix + regularFile,
+			setup: func(t *testing.T) {
+				if err := os.WriteFile(regularFile, []byte("keep me"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			check: func(t *testing.T, address net.Addr) {
+				if content, err := os.ReadFile(regularFile); err != nil || string(content) != "keep me" {
+					t.Fatalf("expected the file to be left alone, got %q, %v", content, err)
+				}
+			},
+			fails: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.setup != nil {
+				c.setup(t)
+			}
+			listener, err := listenOn(c.address, 0)
+			if c.fails {
+				if err == nil {
+					listener.Close()
+					t.Fatal("expected an error")
+				}
+				c.check(t, nil)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			c.check(t, listener.Addr())
+		})
+	}
+}
+
+func TestListenClosesOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "api.sock")
+
+	_, err := listen([]string{unixPrefix + socket, "127.0.0.1:0", unixPrefix + filepath.Join(dir, "missing", "api.sock")}, "")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	// closing a Unix listener removes its socket
+	if _, err := os.Lstat(socket); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected the first listener to be closed, got %v", err)
+	}
+
+	listeners, err := listen([]string{unixPrefix + socket, " 127.0.0.1:0"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("expected 2 listeners, got %d", len(listeners))
+	}
+}
+
+func TestSocketMode(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "api.sock")
+
+	listeners, err := listen([]string{unixPrefix + socket}, "0666")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listeners[0].Close()
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o666 {
+		t.Fatalf("expected the socket to be readable and writable by everyone, got %v", info.Mode())
+	}
+
+	for _, mode := range []string{"rw-rw----", "0999", "17777"} {
+		if _, err := listen([]string{"127.0.0.1:0"}, mode); err == nil {
+			t.Errorf("expected the mode %s to be refused", mode)
+		}
+	}
+}
@@ -1,22 +1,33 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"reflect"
 	"strings"
+	"syscall"
 
 	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
-	"github.com/NebN/unraid-simple-monitoring-api/internal/monitor"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/notify"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/publish"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
 	"gopkg.in/yaml.v3"
 )
 
-const PORT = "24940"
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(runExport(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		os.Exit(runHashPassword())
+	}
+
 	slog.SetLogLoggerLevel(slog.LevelDebug)
 	mux := http.NewServeMux()
 	confPath := os.Getenv("CONF_PATH")
@@ -49,72 +60,159 @@ func main() {
 		slog.Debug("Configuration", "conf", configuration)
 	}
 
-	rootHandler := NewHandler(configuration)
+	// stopping the container cancels it, the storage then writing what it has not yet
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var storage *report.Storage
+	if configuration.Storage != nil {
+		storage, err = report.NewStorage(*configuration.Storage)
+		if err != nil {
+			slog.Error("Cannot open storage", slog.String("path", configuration.Storage.Path), slog.String("error", err.Error()))
+			return
+		}
+		defer func() {
+			if err := storage.Close(); err != nil {
+				slog.Error("Unable to close storage", slog.String("error", err.Error()))
+			}
+		}()
+		go storage.Run(ctx)
+	}
+	var history *report.History
+	if *configuration.History.Enabled || storage != nil {
+		history = report.NewHistory(configuration.History, configuration.SampleInterval, configuration.Units, report.NewFilter(configuration.Include, configuration.Exclude), storage)
+	} else {
+		slog.Info("History disabled")
+	}
+	collector := report.NewCollector(configuration)
+	if len(configuration.Notifiers) > 0 {
+		collector.Alerts.SetNotifier(notify.NewNotifier(configuration.Notifiers))
+	}
+	sampler := report.NewSampler(collector, history, configuration.SampleInterval)
+	go sampler.Run(ctx)
+	if configuration.Mqtt != nil {
+		mqttPublisher := publish.NewMqttPublisher(*configuration.Mqtt, configuration.Units, report.NewFilter(configuration.Include, configuration.Exclude))
+		go mqttPublisher.Run(ctx, sampler)
+	}
+	if configuration.Influx != nil {
+		influxExporter := publish.NewInfluxExporter(*configuration.Influx, configuration.Units, report.NewFilter(configuration.Include, configuration.Exclude))
+		go influxExporter.Run(ctx, sampler)
+	}
+	if configuration.Graphite != nil {
+		graphiteExporter := publish.NewGraphiteExporter(*configuration.Graphite, configuration.Units, report.NewFilter(configuration.Include, configuration.Exclude))
+		go graphiteExporter.Run(ctx, sampler)
+	}
+	if configuration.Statsd != nil {
+		statsdExporter := publish.NewStatsdExporter(*configuration.Statsd, configuration.Units, report.NewFilter(configuration.Include, configuration.Exclude))
+		go statsdExporter.Run(ctx, sampler)
+	}
+
+	rootHandler := NewHandler(configuration, sampler)
 	mux.Handle("/", &rootHandler)
+	mux.HandleFunc("/metrics", rootHandler.ServeMetrics)
+	registerApi(mux, &rootHandler)
+
+	server := &http.Server{Handler: mux}
+	if configuration.Auth != nil {
+		auth, err := newAuthenticator(*configuration.Auth, configuration.Cors)
+		if err != nil {
+			slog.Error("Invalid auth configuration", slog.String("error", err.Error()))
+			return
+		}
+		server.Handler = auth.wrap(mux, &rootHandler)
+	}
+	serve := server.Serve
+	scheme := "HTTP"
+	if configuration.Tls != nil {
+		reloader, err := newCertificateReloader(*configuration.Tls)
+		if err != nil {
+			slog.Error("Cannot load certificate", slog.String("error", err.Error()))
+			return
+		}
+		server.TLSConfig = reloader.tlsConfig()
+		go reloader.Run(ctx)
+		serve = func(listener net.Listener) error { return server.ServeTLS(listener, "", "") }
+		scheme = "HTTPS"
+	}
 
-	slog.Info(fmt.Sprintf("API running on port %s ...", PORT))
-	err = http.ListenAndServe(fmt.Sprintf(":%s", "24940"), mux)
+	listeners, err := listen(configuration.Listen, configuration.SocketMode)
 	if err != nil {
 		slog.Error("Cannot start API", slog.String("error", err.Error()))
+		return
+	}
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		slog.Info(fmt.Sprintf("API running on %s over %s ...", listener.Addr(), scheme))
+		go func(listener net.Listener) {
+			errs <- serve(listener)
+		}(listener)
+	}
+	// a listener failing stops the API, the container being restarted rather than left half reachable
+	select {
+	case err = <-errs:
+		slog.Error("API stopped", slog.String("error", err.Error()))
+	case <-ctx.Done():
+		slog.Info("API stopping")
 	}
+	server.Close()
 }
 
 type handler struct {
-	NetworkMonitor monitor.NetworkMonitor
-	DiskMonitor    monitor.DiskMonitor
-	CpuMonitor     monitor.CpuMonitor
-	MemoryMonitor  monitor.MemoryMonitor
-	Cors           *conf.Cors
+	Sampler *report.Sampler
+	Filter  report.Filter
+	Cors    *conf.Cors
+	Units   conf.Units
 }
 
-func NewHandler(conf conf.Conf) (handler handler) {
-	handler.DiskMonitor = monitor.NewDiskMonitor(conf.Disks, conf.Units)
-	handler.NetworkMonitor = monitor.NewNetworkMonitor(conf.Networks)
-	handler.CpuMonitor = monitor.NewCpuMonitor(conf.CpuTemp)
-	handler.MemoryMonitor = monitor.NewMemoryMonitor(conf.Units.Memory)
+func NewHandler(conf conf.Conf, sampler *report.Sampler) (handler handler) {
+	handler.Sampler = sampler
+	handler.Filter = report.NewFilter(conf.Include, conf.Exclude)
 	handler.Cors = conf.Cors
+	handler.Units = conf.Units
 	return
 }
 
-func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-
-	slog.Debug("Request received", slog.String("request", fmt.Sprintf("%+v\n", r)))
-
-	diskUsage := h.DiskMonitor.ComputeDiskUsage()
-	network := h.NetworkMonitor.ComputeNetworkRate()
-	cacheTotal := monitor.AggregateDiskStatuses(diskUsage.Cache)
-	arrayTotal := monitor.AggregateDiskStatuses(diskUsage.Array)
-	networkTotal := monitor.AggregateNetworkRates(network)
-	cpu, cores := h.CpuMonitor.ComputeCpuStatus()
-	memory := h.MemoryMonitor.ComputeMemoryUsage()
-
-	response := Report{
-		Cache:        diskUsage.Cache,
-		Array:        diskUsage.Array,
-		Pools:        diskUsage.Pools,
-		Parity:       diskUsage.Party,
-		Network:      network,
-		ArrayTotal:   arrayTotal,
-		CacheTotal:   cacheTotal,
-		NetworkTotal: networkTotal,
-		Cpu:          cpu,
-		Cores:        cores,
-		Memory:       memory,
-		Error:        nil,
+// sample returns the latest sample, waiting for the first one if needed, without the alerts on paths the request may not read.
+// It is false when the request has been cancelled meanwhile, nothing being left to respond to.
+func (h *handler) sample(r *http.Request) (report.Report, bool) {
+	sample, err := h.Sampler.Report(r.Context())
+	if err != nil {
+		slog.Debug("Request cancelled while waiting for the first sample", "remote", r.RemoteAddr)
+		return sample, false
 	}
+	sample.Alerts = report.AllowedAlerts(sample.Alerts, h.filter(r))
+	return sample, true
+}
 
-	w.Header().Set("Content-Type", "application/json")
+func (h *handler) setCorsHeaders(w http.ResponseWriter) {
 	if h.Cors != nil {
 		w.Header().Set("Access-Control-Allow-Origin", h.Cors.Origin)
 		w.Header().Set("Access-Control-Allow-Methods", h.Cors.Methods)
 		w.Header().Set("Access-Control-Allow-Headers", h.Cors.Headers)
 	}
-	responseJson, err := json.Marshal(response)
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	slog.Debug("Request received", "method", r.Method, "url", r.URL.String(), "remote", r.RemoteAddr)
+
+	sample, ok := h.sample(r)
+	if !ok {
+		return
+	}
+	response, err := h.filter(r).Apply(sample)
+
+	w.Header().Set("Content-Type", "application/json")
+	h.setCorsHeaders(w)
+	var responseJson []byte
+	if err == nil {
+		responseJson, err = json.Marshal(response)
+	}
 	if err != nil {
 		slog.Error("Error trying to respond to API call",
 			slog.String("error", err.Error()),
 			slog.String("attempting to marshal", fmt.Sprintf("%+v\n", response)))
-		errorResponse, _ := json.Marshal(newErrorReport(err.Error()))
+		errorResponse, _ := json.Marshal(report.NewErrorReport(err.Error()))
 		w.Write([]byte(errorResponse))
 	} else {
 		slog.Debug("Responding to request", "response", responseJson)
@@ -122,28 +220,20 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-type Report struct {
-	Array        []monitor.DiskStatus   `json:"array"`
-	Cache        []monitor.DiskStatus   `json:"cache"`
-	Pools        []monitor.PoolStatus   `json:"pools"`
-	Parity       []monitor.ParityStatus `json:"parity"`
-	Network      []monitor.NetworkRate  `json:"network"`
-	ArrayTotal   monitor.DiskStatus     `json:"array_total"`
-	CacheTotal   monitor.DiskStatus     `json:"cache_total"`
-	NetworkTotal monitor.NetworkRate    `json:"network_total"`
-	Cpu          monitor.CpuStatus      `json:"cpu"`
-	Cores        []monitor.CoreStatus   `json:"cores"`
-	Memory       monitor.MemoryStatus   `json:"memory"`
-	Error        *string                `json:"error"`
-}
-
-func newErrorReport(err string) (report Report) {
+func (h *handler) ServeMetrics(w http.ResponseWriter, r *http.Request) {
 
-	report.Array = make([]monitor.DiskStatus, 0)
-	report.Cache = make([]monitor.DiskStatus, 0)
-	report.Network = make([]monitor.NetworkRate, 0)
+	slog.Debug("Metrics request received", "url", r.URL.String(), "remote", r.RemoteAddr)
 
-	report.Error = &err
+	sample, ok := h.sample(r)
+	if !ok {
+		return
+	}
+	metrics := report.FilterMetrics(report.Metrics(sample, h.Units), h.filter(r))
 
-	return
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	h.setCorsHeaders(w)
+	err := report.WritePrometheus(w, metrics)
+	if err != nil {
+		slog.Error("Error trying to respond to metrics call", slog.String("error", err.Error()))
+	}
 }
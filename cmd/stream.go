@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+	"github.com/gorilla/websocket"
+)
+
+const streamWriteTimeout = 10 * time.Second
+
+// subscription is what a streaming client asked for, either through query parameters
+// or, for WebSockets, through a JSON message sent at any time.
+type subscription struct {
+	Subsystems []string `json:"subsystems"`
+	Interval   string   `json:"interval"`
+	Delta      bool     `json:"delta"`
+	interval   time.Duration
+}
+
+func parseSubscriptionQuery(query url.Values, minInterval time.Duration) (subscription, error) {
+	sub := subscription{Interval: query.Get("interval")}
+	if subsystems := query.Get("subsystems"); subsystems != "" {
+		sub.Subsystems = strings.Split(subsystems, ",")
+	}
+	if delta := query.Get("delta"); delta != "" {
+		parsed, err := strconv.ParseBool(delta)
+		if err != nil {
+			return sub, fmt.Errorf("unable to parse delta %s", delta)
+		}
+		sub.Delta = parsed
+	}
+	return sub, sub.validate(minInterval)
+}
+
+// validate checks the requested subsystems and interval,
+// intervals shorter than the sampling interval would only send the same sample again.
+func (sub *subscription) validate(minInterval time.Duration) error {
+	for _, name := range sub.Subsystems {
+		if _, err := (report.Report{}).Subsystem(name); err != nil {
+			return err
+		}
+	}
+
+	sub.interval = minInterval
+	if sub.Interval != "" {
+		interval, err := time.ParseDuration(sub.Interval)
+		if err != nil {
+			seconds, secondsErr := strconv.ParseFloat(sub.Interval, 64)
+			if secondsErr != nil {
+				return fmt.Errorf("unable to parse interval %s", sub.Interval)
+			}
+			interval = time.Duration(seconds * float64(time.Second))
+		}
+		if interval > minInterval {
+			sub.interval = interval
+		}
+	}
+	return nil
+}
+
+type streamer struct {
+	sampler *report.Sampler
+	filter  report.Filter
+	sub     subscription
+	delta   *report.Delta
+}
+
+func newStreamer(h *handler, r *http.Request, sub subscription) *streamer {
+	return &streamer{sampler: h.Sampler, filter: h.filter(r), sub: sub, delta: report.NewDelta()}
+}
+
+// next returns the payload to send, send is false when running in delta mode and nothing changed.
+func (s *streamer) next(ctx context.Context) (payload []byte, send bool, err error) {
+	sample, err := s.sampler.Report(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	sample.Alerts = report.AllowedAlerts(sample.Alerts, s.filter)
+
+	if len(s.sub.Subsystems) == 0 && !s.sub.Delta {
+		filtered, err := s.filter.Apply(sample)
+		if err != nil {
+			return nil, false, err
+		}
+		payload, err = json.Marshal(filtered)
+		return payload, err == nil, err
+	}
+
+	subsystems := s.sub.Subsystems
+	if len(subsystems) == 0 {
+		subsystems = report.Subsystems
+	}
+
+	if !s.sub.Delta {
+		s.delta = report.NewDelta()
+	}
+	changed, err := s.delta.Changed(sample, subsystems, s.filter)
+	if err != nil || len(changed) == 0 {
+		return nil, false, err
+	}
+
+	sampledAt, _ := json.Marshal(sample.SampledAt)
+	changed["sampled_at"] = sampledAt
+	payload, err = json.Marshal(changed)
+	return payload, err == nil, err
+}
+
+func (h *handler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	sub, err := parseSubscriptionQuery(r.URL.Query(), h.Sampler.Interval())
+	if err != nil {
+		h.writeJson(w, http.StatusBadRequest, report.ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.writeJson(w, http.StatusInternalServerError, report.ErrorResponse{Error: "streaming is not supported"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	h.setCorsHeaders(w)
+
+	slog.Debug("Event stream opened", "remote", r.RemoteAddr, "subscription", sub)
+	defer slog.Debug("Event stream closed", "remote", r.RemoteAddr)
+
+	streamer := newStreamer(h, r, sub)
+	ticker := time.NewTicker(sub.interval)
+	defer ticker.Stop()
+
+	for {
+		payload, send, err := streamer.next(r.Context())
+		if r.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Error("Event stream unable to prepare payload", slog.String("error", err.Error()))
+			return
+		}
+		if send {
+			if _, err := fmt.Fprintf(w, "event: report\ndata: %s\n\n", payload); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *handler) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	sub, err := parseSubscriptionQuery(r.URL.Query(), h.Sampler.Interval())
+	if err != nil {
+		h.writeJson(w, http.StatusBadRequest, report.ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	upgrader := websocket.Upgrader{}
+	if h.Cors != nil {
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || h.Cors.Origin == "*" || h.Cors.Origin == origin
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("WebSocket unable to upgrade connection", slog.String("error", err.Error()))
+		return
+	}
+	defer conn.Close()
+
+	slog.Debug("WebSocket opened", "remote", r.RemoteAddr, "subscription", sub)
+	defer slog.Debug("WebSocket closed", "remote", r.RemoteAddr)
+
+	// the request's context is not cancelled once the connection has been hijacked
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	subscriptions := make(chan subscription)
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(closed)
+		defer cancel()
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var newSub subscription
+			if err := json.Unmarshal(message, &newSub); err != nil {
+				slog.Warn("WebSocket unable to parse subscription", slog.String("error", err.Error()))
+				continue
+			}
+			if err := newSub.validate(h.Sampler.Interval()); err != nil {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseUnsupportedData, err.Error()),
+					time.Now().Add(streamWriteTimeout))
+				return
+			}
+			select {
+			case subscriptions <- newSub:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	streamer := newStreamer(h, r, sub)
+	ticker := time.NewTicker(sub.interval)
+	defer ticker.Stop()
+
+	for {
+		payload, send, err := streamer.next(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Error("WebSocket unable to prepare payload", slog.String("error", err.Error()))
+			return
+		}
+		if send {
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-closed:
+			return
+		case newSub := <-subscriptions:
+			slog.Debug("WebSocket subscription changed", "remote", r.RemoteAddr, "subscription", newSub)
+			streamer = newStreamer(h, r, newSub)
+			ticker.Reset(newSub.interval)
+		case <-ticker.C:
+		}
+	}
+}
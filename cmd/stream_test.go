@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/monitor"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+)
+
+// testHandler serves the memory and network totals, waiting for the first sample to be taken
+func testHandler(t *testing.T, configuration conf.Conf) *handler {
+	return testCollectorHandler(t, configuration, &report.Collector{
+		Filter:         report.NewFilter([]string{"memory", "network_total"}, nil),
+		MemoryMonitor:  monitor.NewMemoryMonitor("Mi"),
+		NetworkMonitor: monitor.NewNetworkMonitor(nil),
+	})
+}
+
+// testCollectorHandler serves what the collector collects, waiting for the first sample to be taken
+func testCollectorHandler(t *testing.T, configuration conf.Conf, collector *report.Collector) *handler {
+	sampler := report.NewSampler(collector, nil, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go sampler.Run(ctx)
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	if _, err := sampler.Report(waitCtx); err != nil {
+		t.Fatalf("no sample taken: %v", err)
+	}
+	h := NewHandler(configuration, sampler)
+	return &h
+}
+
+func TestParseSubscriptionQuery(t *testing.T) {
+	cases := []struct {
+		query    string
+		interval time.Duration
+		fails    bool
+	}{
+		{"", 5 * time.Second, false},
+		{"interval=30s", 30 * time.Second, false},
+		{"interval=12.5", 12500 * time.Millisecond, false},
+		{"interval=1s", 5 * time.Second, false},
+		{"interval=soon", 0, true},
+		{"subsystems=cpu,memory&delta=true", 5 * time.Second, false},
+		{"subsystems=cpu,gpu", 0, true},
+		{"delta=maybe", 0, true},
+	}
+	for _, c := range cases {
+		query, _ := url.ParseQuery(c.query)
+		sub, err := parseSubscriptionQuery(query, 5*time.Second)
+		if c.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.query)
+			}
+			continue
+		}
+		if err != nil || sub.interval != c.interval {
+			t.Errorf("%s: expected %s, got %s %v", c.query, c.interval, sub.interval, err)
+		}
+	}
+}
+
+func TestStreamerDelta(t *testing.T) {
+	h := testHandler(t, conf.Conf{})
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/stream", nil)
+	streamer := newStreamer(h, request, subscription{Subsystems: []string{report.SubsystemMemory, report.SubsystemNetwork}, Delta: true})
+
+	payload, send, err := streamer.next(context.Background())
+	if err != nil || !send || !strings.Contains(string(payload), `"memory"`) || !strings.Contains(string(payload), `"network"`) {
+		t.Fatalf("expected every subscribed subsystem the first time, got %s %v %v", payload, send, err)
+	}
+	if payload, send, err := streamer.next(context.Background()); err != nil || send {
+		t.Fatalf("expected nothing to be sent as the sample did not change, got %s %v", payload, err)
+	}
+}
+
+func TestServeEvents(t *testing.T) {
+	h := testHandler(t, conf.Conf{})
+	server := httptest.NewServer(http.HandlerFunc(h.serveEvents))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "?subsystems=memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %s", contentType)
+	}
+
+	reader := bufio.NewReader(response.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	if lines[0] != "event: report" || !strings.HasPrefix(lines[1], `data: {"memory":`) || lines[2] != "" {
+		t.Fatalf("unexpected event framing %q", lines)
+	}
+}
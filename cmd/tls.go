@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+)
+
+// certificateReloader keeps the certificate and client CA in use, loading them again once their files change,
+// e.g. after a renewal. The previous ones are kept when the new files cannot be loaded.
+type certificateReloader struct {
+	conf conf.Tls
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	clientCas   *x509.CertPool
+	modified    map[string]time.Time
+}
+
+// clientAuthTypes are the values of clientAuth, which only applies along with clientCa
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"require":  tls.RequireAndVerifyClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+}
+
+func newCertificateReloader(configuration conf.Tls) (*certificateReloader, error) {
+	if configuration.ClientAuth != "" {
+		if _, found := clientAuthTypes[configuration.ClientAuth]; !found {
+			return nil, fmt.Errorf("unknown clientAuth %q, expected require or optional", configuration.ClientAuth)
+		}
+		if configuration.ClientCa == "" {
+			return nil, fmt.Errorf("clientAuth %s needs clientCa, the CA client certificates are verified against", configuration.ClientAuth)
+		}
+	}
+
+	reloader := &certificateReloader{conf: configuration}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// tlsConfig hands out the latest certificate and client CA on every handshake
+func (reloader *certificateReloader) tlsConfig() *tls.Config {
+	clientAuth := tls.NoClientCert
+	if reloader.conf.ClientCa != "" {
+		clientAuth = clientAuthTypes[reloader.conf.ClientAuth]
+	}
+
+	// the config returned per client replaces the server's one entirely, HTTP/2 has to be offered again
+	base := &tls.Config{MinVersion: tls.VersionTLS12, ClientAuth: clientAuth, NextProtos: []string{"h2", "http/1.1"}}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			reloader.mu.RLock()
+			defer reloader.mu.RUnlock()
+			config := base.Clone()
+			config.Certificates = []tls.Certificate{*reloader.certificate}
+			config.ClientCAs = reloader.clientCas
+			return config, nil
+		},
+	}
+}
+
+// Run checks the files on every reload interval, until the context is cancelled
+func (reloader *certificateReloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(reloader.conf.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !reloader.changed() {
+				continue
+			}
+			if err := reloader.load(); err != nil {
+				slog.Error("Unable to reload certificate, keeping the previous one", slog.String("error", err.Error()))
+				continue
+			}
+			slog.Info("Certificate reloaded", "cert", reloader.conf.Cert)
+		}
+	}
+}
+
+func (reloader *certificateReloader) files() []string {
+	files := []string{reloader.conf.Cert, reloader.conf.Key}
+	if reloader.conf.ClientCa != "" {
+		files = append(files, reloader.conf.ClientCa)
+	}
+	return files
+}
+
+// changed compares the modification times, following symlinks as certificates are often swapped by relinking them
+func (reloader *certificateReloader) changed() bool {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+	for _, file := range reloader.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			slog.Debug("Unable to check certificate file", slog.String("file", file), slog.String("error", err.Error()))
+			continue
+		}
+		if !info.ModTime().Equal(reloader.modified[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (reloader *certificateReloader) load() error {
+	modified := make(map[string]time.Time)
+	for _, file := range reloader.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modified[file] = info.ModTime()
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.conf.Cert, reloader.conf.Key)
+	if err != nil {
+		return err
+	}
+
+	var clientCas *x509.CertPool
+	if reloader.conf.ClientCa != "" {
+		pem, err := os.ReadFile(reloader.conf.ClientCa)
+		if err != nil {
+			return err
+		}
+		clientCas = x509.NewCertPool()
+		if !clientCas.AppendCertsFromPEM(pem) {
+			return errors.New("no certificate found in " + reloader.conf.ClientCa)
+		}
+	}
+
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+	reloader.certificate = &certificate
+	reloader.clientCas = clientCas
+	reloader.modified = modified
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+)
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 and its key, returning the certificate
+func writeCertificate(t *testing.T, certPath string, keyPath string, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+// testTlsServer serves 200 OK with the reloader's configuration
+func testTlsServer(t *testing.T, reloader *certificateReloader) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = reloader.tlsConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// servedCommonName connects to the server and returns the common name of the certificate it presents
+func servedCommonName(t *testing.T, server *httptest.Server) string {
+	connection, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	return connection.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certPath, keyPath, "first")
+
+	reloader, err := newCertificateReloader(conf.Tls{Cert: certPath, Key: keyPath, ReloadInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := testTlsServer(t, reloader)
+	if name := servedCommonName(t, server); name != "first" {
+		t.Fatalf("expected the first certificate, got %s", name)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Run(ctx)
+
+	writeCertificate(t, certPath, keyPath, "renewed")
+	// the files may be rewritten within the filesystem's timestamp granularity
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{certPath, keyPath} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for servedCommonName(t, server) != "renewed" {
+		if time.Now().After(deadline) {
+			t.Fatal("the renewed certificate was never served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	serverCertificate := writeCertificate(t, certPath, keyPath, "server")
+	caPath, caKeyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	writeCertificate(t, caPath, caKeyPath, "client ca")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCertificate)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	cases := []struct {
+		clientAuth string
+		accepted   bool
+	}{
+		{"require", false},
+		{"optional", true},
+	}
+	for _, c := range cases {
+		t.Run(c.clientAuth, func(t *testing.T) {
+			reloader, err := newCertificateReloader(conf.Tls{Cert: certPath, Key: keyPath, ClientCa: caPath, ClientAuth: c.clientAuth})
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := testTlsServer(t, reloader)
+
+			// without a client certificate
+			response, err := client.Get(server.URL)
+			if c.accepted {
+				if err != nil {
+					t.Fatalf("expected to be accepted, got %v", err)
+				}
+				response.Body.Close()
+			} else if err == nil {
+				response.Body.Close()
+				t.Fatal("expected to be refused")
+			}
+		})
+	}
+
+	for _, invalid := range []conf.Tls{
+		{Cert: certPath, Key: keyPath, ClientCa: caPath, ClientAuth: "sometimes"},
+		{Cert: certPath, Key: keyPath, ClientAuth: "require"},
+		{Cert: certPath, Key: keyPath, ClientAuth: "optional"},
+	} {
+		if _, err := newCertificateReloader(invalid); err == nil {
+			t.Errorf("expected clientAuth %s with clientCa %q to be refused", invalid.ClientAuth, invalid.ClientCa)
+		}
+	}
+}
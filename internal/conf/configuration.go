@@ -1,20 +1,40 @@
 package conf
 
 import (
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Conf struct {
-	Networks     []string            `yaml:"networks"`
-	Disks        map[string][]string `yaml:"disks"`
-	Units        Units               `yaml:"units"`
-	LoggingLevel string              `yaml:"loggingLevel"`
-	CpuTemp      *string             `yaml:"cpuTemp"`
-	Include      []string            `yaml:"include"`
-	Exclude      []string            `yaml:"exclude"`
-	Cors         *Cors               `yaml:"cors"`
+	Networks       []string            `yaml:"networks"`
+	Disks          map[string][]string `yaml:"disks"`
+	Units          Units               `yaml:"units"`
+	LoggingLevel   string              `yaml:"loggingLevel"`
+	CpuTemp        *string             `yaml:"cpuTemp"`
+	Include        []string            `yaml:"include"`
+	Exclude        []string            `yaml:"exclude"`
+	Cors           *Cors               `yaml:"cors"`
+	SampleInterval time.Duration       `yaml:"sampleInterval"`
+	Smart          *Smart              `yaml:"smart"`
+	Shares         *Shares             `yaml:"shares"`
+	Forecast       Forecast            `yaml:"forecast"`
+	History        History             `yaml:"history"`
+	Storage        *Storage            `yaml:"storage"`
+	Alerts         []AlertRule         `yaml:"alerts"`
+	Notifiers      []Notifier          `yaml:"notifiers"`
+	Mqtt           *Mqtt               `yaml:"mqtt"`
+	Influx         *Influx             `yaml:"influx"`
+	Graphite       *Graphite           `yaml:"graphite"`
+	Statsd         *Graphite           `yaml:"statsd"`
+	Tls            *Tls                `yaml:"tls"`
+	Auth           *Auth               `yaml:"auth"`
+	Listen         []string            `yaml:"listen"`
+	SocketMode     string              `yaml:"socketMode"`
 }
 
 type Cors struct {
@@ -23,6 +43,151 @@ type Cors struct {
 	Headers string `yaml:"headers"`
 }
 
+// Tls serves the API over HTTPS, the certificate being reloaded when its files change.
+// Clients must present a certificate signed by ClientCa when it is set, unless ClientAuth is "optional".
+type Tls struct {
+	Cert           string        `yaml:"cert"`
+	Key            string        `yaml:"key"`
+	ClientCa       string        `yaml:"clientCa"`
+	ClientAuth     string        `yaml:"clientAuth"`
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+}
+
+// Auth requires every request but the health check to present one of the tokens, or one of the users' credentials.
+type Auth struct {
+	Tokens []AuthToken `yaml:"tokens"`
+	Users  []AuthUser  `yaml:"users"`
+}
+
+// AuthScope limits what can be read, Scopes and Exclude being paths as in Conf.Include and Conf.Exclude.
+// Without scopes, everything the configuration allows can be read.
+type AuthScope struct {
+	Scopes  []string `yaml:"scopes"`
+	Exclude []string `yaml:"exclude"`
+}
+
+type AuthToken struct {
+	Name      string `yaml:"name"`
+	Token     string `yaml:"token"`
+	AuthScope `yaml:",inline"`
+}
+
+// AuthUser is checked through HTTP basic auth, Password being a bcrypt hash
+type AuthUser struct {
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+	AuthScope `yaml:",inline"`
+}
+
+type Smart struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+type Shares struct {
+	SizeInterval time.Duration `yaml:"sizeInterval"`
+}
+
+type Forecast struct {
+	Path   string        `yaml:"path"`
+	Window time.Duration `yaml:"window"`
+}
+
+// History is kept in memory with the default tiers unless disabled, or given tiers, an empty list also disabling it
+type History struct {
+	Enabled *bool         `yaml:"enabled"`
+	Tiers   []HistoryTier `yaml:"tiers"`
+}
+
+// HistoryTier keeps one point per resolution, for as long as the retention
+type HistoryTier struct {
+	Resolution time.Duration `yaml:"resolution"`
+	Retention  time.Duration `yaml:"retention"`
+}
+
+type Storage struct {
+	Path            string        `yaml:"path"`
+	CompactInterval time.Duration `yaml:"compactInterval"`
+	Tiers           []HistoryTier `yaml:"tiers"`
+}
+
+// AlertRule fires when Expr, such as "cpu.temp > 80", has been true for For,
+// and resolves once the value is back past the threshold by Hysteresis
+type AlertRule struct {
+	Name       string        `yaml:"name"`
+	Expr       string        `yaml:"expr"`
+	For        time.Duration `yaml:"for"`
+	Severity   string        `yaml:"severity"`
+	Hysteresis float64       `yaml:"hysteresis"`
+}
+
+// Notifier delivers alerts to a sink, Type being one of webhook, ntfy, gotify, discord, slack, smtp or unraid
+type Notifier struct {
+	Type       string            `yaml:"type"`
+	Name       string            `yaml:"name"`
+	Url        string            `yaml:"url"`
+	Token      string            `yaml:"token"`
+	Template   string            `yaml:"template"`
+	Headers    map[string]string `yaml:"headers"`
+	Smtp       *Smtp             `yaml:"smtp"`
+	Command    string            `yaml:"command"`
+	Severities []string          `yaml:"severities"`
+	Retries    *int              `yaml:"retries"`
+	Backoff    time.Duration     `yaml:"backoff"`
+	RateLimit  int               `yaml:"rateLimit"`
+	RatePeriod time.Duration     `yaml:"ratePeriod"`
+	Dedup      time.Duration     `yaml:"dedup"`
+}
+
+type Smtp struct {
+	Host     string   `yaml:"host"`
+	Port     int      `yaml:"port"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+type Mqtt struct {
+	Broker          string        `yaml:"broker"`
+	Username        string        `yaml:"username"`
+	Password        string        `yaml:"password"`
+	ClientId        string        `yaml:"clientId"`
+	TopicPrefix     string        `yaml:"topicPrefix"`
+	Qos             byte          `yaml:"qos"`
+	Retain          bool          `yaml:"retain"`
+	Interval        time.Duration `yaml:"interval"`
+	Discovery       *bool         `yaml:"discovery"`
+	DiscoveryPrefix string        `yaml:"discoveryPrefix"`
+	DeviceName      string        `yaml:"deviceName"`
+}
+
+// Influx writes to a v2 bucket when Bucket is set, to a v1 database otherwise.
+// Points that cannot be written are kept in the file at BufferPath, up to BufferMaxSize bytes.
+type Influx struct {
+	Url             string            `yaml:"url"`
+	Token           string            `yaml:"token"`
+	Org             string            `yaml:"org"`
+	Bucket          string            `yaml:"bucket"`
+	Database        string            `yaml:"database"`
+	RetentionPolicy string            `yaml:"retentionPolicy"`
+	Username        string            `yaml:"username"`
+	Password        string            `yaml:"password"`
+	Tags            map[string]string `yaml:"tags"`
+	Interval        time.Duration     `yaml:"interval"`
+	BatchSize       int               `yaml:"batchSize"`
+	Retries         *int              `yaml:"retries"`
+	Backoff         time.Duration     `yaml:"backoff"`
+	BufferPath      string            `yaml:"bufferPath"`
+	BufferMaxSize   int64             `yaml:"bufferMaxSize"`
+}
+
+// Graphite is used both for the Graphite plaintext protocol over TCP and for StatsD gauges over UDP
+type Graphite struct {
+	Address  string        `yaml:"address"`
+	Prefix   string        `yaml:"prefix"`
+	Interval time.Duration `yaml:"interval"`
+}
+
 type Units struct {
 	Array  string `yaml:"array"`
 	Cache  string `yaml:"cache"`
@@ -45,7 +210,51 @@ func rawConf(path string) (Conf, error) {
 	return conf, nil
 }
 
+const defaultPort = "24940"
+const defaultSampleInterval = 5 * time.Second
+const defaultSmartInterval = 30 * time.Minute
+const defaultSharesSizeInterval = 6 * time.Hour
+const defaultForecastWindow = 30 * 24 * time.Hour
+const defaultForecastFile = "forecast.json"
+const defaultStorageFile = "metrics.db"
+const defaultStorageCompactInterval = time.Hour
+const defaultAlertSeverity = "warning"
+const defaultNotifierRetries = 3
+const defaultNotifierBackoff = 5 * time.Second
+const defaultNotifierRateLimit = 20
+const defaultNotifierRatePeriod = time.Hour
+const defaultNotifierDedup = 10 * time.Minute
+const defaultUnraidNotifyCommand = "/usr/local/emhttp/webGui/scripts/notify"
+const defaultSmtpPort = 25
+const defaultMqttClientId = "unraid-simple-monitoring-api"
+const defaultMqttTopicPrefix = "unraid"
+const defaultMqttInterval = 30 * time.Second
+const defaultMqttDiscoveryPrefix = "homeassistant"
+const defaultMqttDeviceName = "Unraid"
+const defaultInfluxInterval = 30 * time.Second
+const defaultInfluxBatchSize = 5000
+const defaultInfluxRetries = 3
+const defaultInfluxBackoff = time.Second
+const defaultInfluxBufferFile = "influx-buffer.lp"
+const defaultInfluxBufferMaxSize = 64 * 1024 * 1024
+const defaultTlsClientAuth = "require"
+const defaultTlsReloadInterval = 30 * time.Second
+const defaultGraphitePrefix = "unraid"
+const defaultGraphiteInterval = 30 * time.Second
+const defaultGraphitePort = "2003"
+const defaultStatsdPort = "8125"
+
 var (
+	defaultHistoryTiers = []HistoryTier{
+		{Resolution: time.Second, Retention: 10 * time.Minute},
+		{Resolution: time.Minute, Retention: 24 * time.Hour},
+		{Resolution: 15 * time.Minute, Retention: 30 * 24 * time.Hour},
+	}
+	defaultStorageTiers = []HistoryTier{
+		{Resolution: time.Minute, Retention: 7 * 24 * time.Hour},
+		{Resolution: 15 * time.Minute, Retention: 90 * 24 * time.Hour},
+		{Resolution: time.Hour, Retention: 365 * 24 * time.Hour},
+	}
 	defaultUnits = Units{
 		Array:  "Gi",
 		Cache:  "Gi",
@@ -67,13 +276,166 @@ func applyDefaults(conf Conf) Conf {
 	if len(conf.Units.Memory) == 0 {
 		conf.Units.Memory = defaultUnits.Memory
 	}
+	if conf.SampleInterval <= 0 {
+		conf.SampleInterval = defaultSampleInterval
+	}
+	if conf.Smart != nil && conf.Smart.Interval <= 0 {
+		conf.Smart.Interval = defaultSmartInterval
+	}
+	if conf.Shares != nil && conf.Shares.SizeInterval <= 0 {
+		conf.Shares.SizeInterval = defaultSharesSizeInterval
+	}
+	if conf.Forecast.Window <= 0 {
+		conf.Forecast.Window = defaultForecastWindow
+	}
+	if conf.History.Enabled != nil && !*conf.History.Enabled {
+		conf.History.Tiers = []HistoryTier{}
+	} else if conf.History.Tiers == nil {
+		// only when the key is absent, tiers: [] disables it as well
+		conf.History.Tiers = defaultHistoryTiers
+	}
+	historyEnabled := len(conf.History.Tiers) > 0
+	conf.History.Enabled = &historyEnabled
+	for i := range conf.Alerts {
+		if conf.Alerts[i].Severity == "" {
+			conf.Alerts[i].Severity = defaultAlertSeverity
+		}
+		if conf.Alerts[i].Name == "" {
+			conf.Alerts[i].Name = conf.Alerts[i].Expr
+		}
+	}
+	for i := range conf.Notifiers {
+		notifier := &conf.Notifiers[i]
+		if notifier.Name == "" {
+			notifier.Name = notifier.Type
+		}
+		if notifier.Retries == nil {
+			retries := defaultNotifierRetries
+			notifier.Retries = &retries
+		}
+		if notifier.Backoff <= 0 {
+			notifier.Backoff = defaultNotifierBackoff
+		}
+		if notifier.RateLimit <= 0 {
+			notifier.RateLimit = defaultNotifierRateLimit
+		}
+		if notifier.RatePeriod <= 0 {
+			notifier.RatePeriod = defaultNotifierRatePeriod
+		}
+		if notifier.Dedup <= 0 {
+			notifier.Dedup = defaultNotifierDedup
+		}
+		if notifier.Type == "unraid" && notifier.Command == "" {
+			notifier.Command = defaultUnraidNotifyCommand
+		}
+		if notifier.Smtp != nil && notifier.Smtp.Port <= 0 {
+			notifier.Smtp.Port = defaultSmtpPort
+		}
+	}
+	if conf.Mqtt != nil {
+		if conf.Mqtt.ClientId == "" {
+			conf.Mqtt.ClientId = defaultMqttClientId
+		}
+		if conf.Mqtt.TopicPrefix == "" {
+			conf.Mqtt.TopicPrefix = defaultMqttTopicPrefix
+		}
+		if conf.Mqtt.Interval <= 0 {
+			conf.Mqtt.Interval = defaultMqttInterval
+		}
+		if conf.Mqtt.Discovery == nil {
+			discovery := true
+			conf.Mqtt.Discovery = &discovery
+		}
+		if conf.Mqtt.DiscoveryPrefix == "" {
+			conf.Mqtt.DiscoveryPrefix = defaultMqttDiscoveryPrefix
+		}
+		if conf.Mqtt.DeviceName == "" {
+			conf.Mqtt.DeviceName = defaultMqttDeviceName
+		}
+	}
+	if conf.Influx != nil {
+		if conf.Influx.Interval <= 0 {
+			conf.Influx.Interval = defaultInfluxInterval
+		}
+		if conf.Influx.BatchSize <= 0 {
+			conf.Influx.BatchSize = defaultInfluxBatchSize
+		}
+		if conf.Influx.Retries == nil {
+			retries := defaultInfluxRetries
+			conf.Influx.Retries = &retries
+		}
+		if conf.Influx.Backoff <= 0 {
+			conf.Influx.Backoff = defaultInfluxBackoff
+		}
+		if conf.Influx.BufferMaxSize <= 0 {
+			conf.Influx.BufferMaxSize = defaultInfluxBufferMaxSize
+		}
+	}
+	if conf.Tls != nil {
+		// only with clientCa, a clientAuth without it being refused
+		if conf.Tls.ClientAuth == "" && conf.Tls.ClientCa != "" {
+			conf.Tls.ClientAuth = defaultTlsClientAuth
+		}
+		if conf.Tls.ReloadInterval <= 0 {
+			conf.Tls.ReloadInterval = defaultTlsReloadInterval
+		}
+	}
+	if conf.Graphite != nil {
+		conf.Graphite = withGraphiteDefaults(*conf.Graphite, defaultGraphitePort)
+	}
+	if conf.Statsd != nil {
+		conf.Statsd = withGraphiteDefaults(*conf.Statsd, defaultStatsdPort)
+	}
+	if conf.Storage != nil {
+		if conf.Storage.CompactInterval <= 0 {
+			conf.Storage.CompactInterval = defaultStorageCompactInterval
+		}
+		if len(conf.Storage.Tiers) == 0 {
+			conf.Storage.Tiers = defaultStorageTiers
+		}
+	}
 	return conf
 }
 
+func withGraphiteDefaults(graphite Graphite, defaultPort string) *Graphite {
+	if graphite.Prefix == "" {
+		graphite.Prefix = defaultGraphitePrefix
+	}
+	if graphite.Interval <= 0 {
+		graphite.Interval = defaultGraphiteInterval
+	}
+	if _, _, err := net.SplitHostPort(graphite.Address); err != nil {
+		graphite.Address = net.JoinHostPort(graphite.Address, defaultPort)
+	}
+	return &graphite
+}
+
 func ReadConf(path string) (Conf, error) {
 	conf, err := rawConf(path)
 	if err != nil {
 		return conf, err
 	}
-	return applyDefaults(conf), nil
+	conf = applyDefaults(conf)
+	// files written by the application are kept next to the configuration, in the appdata directory
+	if conf.Forecast.Path == "" {
+		conf.Forecast.Path = filepath.Join(filepath.Dir(path), defaultForecastFile)
+	}
+	if conf.Storage != nil && conf.Storage.Path == "" {
+		conf.Storage.Path = filepath.Join(filepath.Dir(path), defaultStorageFile)
+	}
+	if conf.Influx != nil && conf.Influx.BufferPath == "" {
+		conf.Influx.BufferPath = filepath.Join(filepath.Dir(path), defaultInfluxBufferFile)
+	}
+	// the environment takes precedence, e.g. to run several instances from the same configuration
+	if listen := os.Getenv("LISTEN"); listen != "" {
+		conf.Listen = strings.Split(listen, ",")
+	}
+	if len(conf.Listen) == 0 {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = defaultPort
+		}
+		conf.Listen = []string{":" + port}
+	}
+	return conf, nil
 }
@@ -0,0 +1,60 @@
+package conf
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestHistoryDefaults(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		enabled bool
+		tiers   []HistoryTier
+	}{
+		{"absent", "loggingLevel: INFO", true, defaultHistoryTiers},
+		{"no tiers", "history: {}", true, defaultHistoryTiers},
+		{"empty tiers", "history: {tiers: []}", false, []HistoryTier{}},
+		{"disabled", "history: {enabled: false, tiers: [{resolution: 1m, retention: 1h}]}", false, []HistoryTier{}},
+		{"tiers", "history: {tiers: [{resolution: 1m, retention: 1h}]}", true, []HistoryTier{{Resolution: time.Minute, Retention: time.Hour}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var raw Conf
+			if err := yaml.Unmarshal([]byte(test.yaml), &raw); err != nil {
+				t.Fatal(err)
+			}
+			history := applyDefaults(raw).History
+			if *history.Enabled != test.enabled || !reflect.DeepEqual(history.Tiers, test.tiers) {
+				t.Fatalf("expected enabled %v with %v, got %v with %v", test.enabled, test.tiers, *history.Enabled, history.Tiers)
+			}
+		})
+	}
+}
+
+func TestTlsDefaults(t *testing.T) {
+	tests := []struct {
+		name       string
+		yaml       string
+		clientAuth string
+	}{
+		{"no client CA", "tls: {cert: cert.pem, key: key.pem}", ""},
+		{"client CA", "tls: {cert: cert.pem, key: key.pem, clientCa: ca.pem}", "require"},
+		{"optional", "tls: {cert: cert.pem, key: key.pem, clientCa: ca.pem, clientAuth: optional}", "optional"},
+		{"without client CA", "tls: {cert: cert.pem, key: key.pem, clientAuth: require}", "require"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var raw Conf
+			if err := yaml.Unmarshal([]byte(test.yaml), &raw); err != nil {
+				t.Fatal(err)
+			}
+			if clientAuth := applyDefaults(raw).Tls.ClientAuth; clientAuth != test.clientAuth {
+				t.Fatalf("expected clientAuth %q, got %q", test.clientAuth, clientAuth)
+			}
+		})
+	}
+}
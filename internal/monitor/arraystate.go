@@ -0,0 +1,35 @@
+package monitor
+
+import (
+	"log/slog"
+)
+
+type ArrayState struct {
+	State       string `json:"state"`
+	Started     bool   `json:"started"`
+	MdState     string `json:"md_state"`
+	NumDisks    uint64 `json:"num_disks"`
+	NumDisabled uint64 `json:"num_disabled"`
+	NumMissing  uint64 `json:"num_missing"`
+	NumInvalid  uint64 `json:"num_invalid"`
+}
+
+// ReadArrayState reads the state of the array from var.ini, e.g. whether it is started and how many disks are disabled.
+func ReadArrayState() (state ArrayState) {
+	varIni, err := readVarIni()
+	if err != nil {
+		slog.Error("Array unable to read var.ini", slog.String("error", err.Error()))
+		return
+	}
+
+	state.State = varIni.Key("fsState").String()
+	state.Started = state.State == "Started"
+	state.MdState = varIni.Key("mdState").String()
+	state.NumDisks = iniUint(varIni, "mdNumDisks")
+	state.NumDisabled = iniUint(varIni, "mdNumDisabled")
+	state.NumMissing = iniUint(varIni, "mdNumMissing")
+	state.NumInvalid = iniUint(varIni, "mdNumInvalid")
+
+	slog.Debug("Array state read", "state", state)
+	return
+}
@@ -0,0 +1,191 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const btrfsSysfsPath = "/sys/fs/btrfs"
+
+// block devices sizes in sysfs are always in 512 bytes sectors
+const sysfsSectorSize = 512
+
+var btrfsProfiles = []string{"single", "dup", "raid0", "raid1", "raid1c3", "raid1c4", "raid10", "raid5", "raid6"}
+
+type BtrfsStatus struct {
+	Uuid            string              `json:"uuid"`
+	Label           string              `json:"label"`
+	DataProfile     string              `json:"data_profile"`
+	MetadataProfile string              `json:"metadata_profile"`
+	Data            BtrfsAllocation     `json:"data"`
+	Metadata        BtrfsAllocation     `json:"metadata"`
+	System          BtrfsAllocation     `json:"system"`
+	Unallocated     float64             `json:"unallocated"`
+	FreeEstimated   float64             `json:"free_estimated"`
+	Devices         []BtrfsDeviceStatus `json:"devices"`
+}
+
+// BtrfsAllocation is the space allocated to chunks of a kind, total and used as seen by the filesystem,
+// raw_total being the space taken on the devices, e.g. twice the total for raid1
+type BtrfsAllocation struct {
+	Total    float64 `json:"total"`
+	Used     float64 `json:"used"`
+	RawTotal float64 `json:"raw_total"`
+}
+
+type BtrfsDeviceStatus struct {
+	Devid            string `json:"devid"`
+	Missing          bool   `json:"missing"`
+	WriteErrors      uint64 `json:"write_errors"`
+	ReadErrors       uint64 `json:"read_errors"`
+	FlushErrors      uint64 `json:"flush_errors"`
+	CorruptionErrors uint64 `json:"corruption_errors"`
+	GenerationErrors uint64 `json:"generation_errors"`
+}
+
+// readBtrfsDevices maps the name of every device belonging to a btrfs filesystem, e.g. sdb1, to the filesystem's uuid
+func readBtrfsDevices() map[string]string {
+	devices := make(map[string]string)
+
+	filesystems, err := os.ReadDir(hostPath(btrfsSysfsPath))
+	if err != nil {
+		slog.Debug("Btrfs no filesystem found", "error", err.Error())
+		return devices
+	}
+
+	for _, filesystem := range filesystems {
+		members, err := os.ReadDir(hostPath(filepath.Join(btrfsSysfsPath, filesystem.Name(), "devices")))
+		if err != nil {
+			continue
+		}
+		for _, member := range members {
+			devices[member.Name()] = filesystem.Name()
+		}
+	}
+
+	slog.Debug("Btrfs devices found", "devices", devices)
+	return devices
+}
+
+func readBtrfsStatus(uuid string, bytesToUnit func(float64) float64) *BtrfsStatus {
+	fsPath := hostPath(filepath.Join(btrfsSysfsPath, uuid))
+
+	readUint := func(path string) uint64 {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			slog.Debug("Btrfs unable to read", "path", path, "error", err.Error())
+			return 0
+		}
+		value, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil {
+			slog.Warn("Btrfs unable to parse", "path", path, "value", string(content))
+			return 0
+		}
+		return value
+	}
+
+	status := BtrfsStatus{Uuid: uuid, Devices: make([]BtrfsDeviceStatus, 0)}
+	if label, err := os.ReadFile(filepath.Join(fsPath, "label")); err == nil {
+		status.Label = strings.TrimSpace(string(label))
+	}
+
+	var rawAllocated, rawSize, dataRawTotal, dataTotal, dataUsed uint64
+	allocation := func(kind string) (BtrfsAllocation, string) {
+		kindPath := filepath.Join(fsPath, "allocation", kind)
+		total := readUint(filepath.Join(kindPath, "total_bytes"))
+		used := readUint(filepath.Join(kindPath, "bytes_used"))
+		rawTotal := readUint(filepath.Join(kindPath, "disk_total"))
+		rawAllocated = rawAllocated + rawTotal
+		if kind == "data" {
+			dataRawTotal, dataTotal, dataUsed = rawTotal, total, used
+		}
+
+		profile := ""
+		for _, candidate := range btrfsProfiles {
+			if info, err := os.Stat(filepath.Join(kindPath, candidate)); err == nil && info.IsDir() {
+				profile = candidate
+				break
+			}
+		}
+
+		return BtrfsAllocation{
+			Total:    bytesToUnit(float64(total)),
+			Used:     bytesToUnit(float64(used)),
+			RawTotal: bytesToUnit(float64(rawTotal)),
+		}, profile
+	}
+	status.Data, status.DataProfile = allocation("data")
+	status.Metadata, status.MetadataProfile = allocation("metadata")
+	status.System, _ = allocation("system")
+
+	members, err := os.ReadDir(filepath.Join(fsPath, "devices"))
+	if err != nil {
+		slog.Error("Btrfs unable to read devices", slog.String("uuid", uuid), slog.String("error", err.Error()))
+	}
+	for _, member := range members {
+		// devices/<name> links to the block device, whose size is in sectors
+		rawSize = rawSize + readUint(filepath.Join(fsPath, "devices", member.Name(), "size"))*sysfsSectorSize
+	}
+
+	if rawSize > rawAllocated {
+		unallocated := float64(rawSize - rawAllocated)
+		status.Unallocated = bytesToUnit(unallocated)
+
+		// unallocated space will be used according to the data profile, e.g. only half of it is usable for raid1
+		dataRatio := 1.0
+		if dataTotal > 0 && dataRawTotal > 0 {
+			dataRatio = float64(dataRawTotal) / float64(dataTotal)
+		}
+		status.FreeEstimated = bytesToUnit(unallocated / dataRatio)
+	}
+	if dataTotal > dataUsed {
+		status.FreeEstimated = status.FreeEstimated + bytesToUnit(float64(dataTotal-dataUsed))
+	}
+
+	devinfos, err := os.ReadDir(filepath.Join(fsPath, "devinfo"))
+	if err != nil {
+		slog.Debug("Btrfs device errors unavailable, they require kernel 5.14", "uuid", uuid)
+	}
+	for _, devinfo := range devinfos {
+		devinfoPath := filepath.Join(fsPath, "devinfo", devinfo.Name())
+		device := BtrfsDeviceStatus{
+			Devid:   devinfo.Name(),
+			Missing: readUint(filepath.Join(devinfoPath, "missing")) == 1,
+		}
+		if content, err := os.ReadFile(filepath.Join(devinfoPath, "error_stats")); err == nil {
+			errorStats := parseBtrfsErrorStats(content)
+			device.WriteErrors = errorStats["write_errs"]
+			device.ReadErrors = errorStats["read_errs"]
+			device.FlushErrors = errorStats["flush_errs"]
+			device.CorruptionErrors = errorStats["corruption_errs"]
+			device.GenerationErrors = errorStats["generation_errs"]
+		}
+		status.Devices = append(status.Devices, device)
+	}
+
+	slog.Debug("Btrfs status read", "status", status)
+	return &status
+}
+
+// parseBtrfsErrorStats parses lines such as "write_errs 0"
+func parseBtrfsErrorStats(content []byte) map[string]uint64 {
+	stats := make(map[string]uint64)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		stats[fields[0]] = value
+	}
+	return stats
+}
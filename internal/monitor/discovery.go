@@ -0,0 +1,84 @@
+package monitor
+
+import (
+	"log/slog"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	diskTypeData  = "Data"
+	diskTypeCache = "Cache"
+)
+
+// updateDiscoveredPools replaces the pools with the ones found in disks.ini, which Unraid keeps up to date,
+// so that disks and pools added in the meantime are picked up.
+func (monitor *DiskMonitor) updateDiscoveredPools(diskIniMap map[string]DiskIni) {
+	if len(diskIniMap) == 0 {
+		// keep the last known pools when disks.ini cannot be read
+		return
+	}
+	pools := discoverPools(diskIniMap)
+	if !reflect.DeepEqual(pools, monitor.pools) {
+		slog.Info("Disk discovered pools", "pools", pools)
+		monitor.pools = pools
+	}
+}
+
+// discoverPools builds the array out of the Data disks, and a pool for every group of Cache devices.
+// Devices of a pool are named after it, followed by their index, e.g. cache, cache2, cache3.
+func discoverPools(diskIniMap map[string]DiskIni) []Pool {
+	arrayDisks := make([]string, 0)
+	poolNames := make(map[string]bool)
+
+	for name, diskIni := range diskIniMap {
+		if diskIni.Status == DiskNotPresent || (diskIni.FsStatus != "" && diskIni.FsStatus != "Mounted") {
+			slog.Debug("Disk skipping unmounted disk", "disk", name, "status", diskIni.Status, "fs status", diskIni.FsStatus)
+			continue
+		}
+
+		switch diskIni.Type {
+		case diskTypeData:
+			arrayDisks = append(arrayDisks, name)
+		case diskTypeCache:
+			poolName := name
+			trimmed := strings.TrimRight(name, "0123456789")
+			if trimmed != name && diskIniMap[trimmed].Type == diskTypeCache {
+				poolName = trimmed
+			}
+			poolNames[poolName] = true
+		}
+	}
+
+	sort.Slice(arrayDisks, func(i, j int) bool {
+		return diskIndex(arrayDisks[i]) < diskIndex(arrayDisks[j])
+	})
+
+	pools := make([]Pool, 0, len(poolNames)+1)
+	if len(arrayDisks) > 0 {
+		mounts := make([]string, len(arrayDisks))
+		for i, name := range arrayDisks {
+			mounts[i] = "/mnt/" + name
+		}
+		pools = append(pools, Pool{Name: arrayLabel, Mounts: mounts})
+	}
+
+	names := make([]string, 0, len(poolNames))
+	for name := range poolNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pools = append(pools, Pool{Name: name, Mounts: []string{"/mnt/" + name}})
+	}
+
+	return pools
+}
+
+// diskIndex returns the number at the end of the name, e.g. 10 for disk10
+func diskIndex(name string) int {
+	index, _ := strconv.Atoi(name[len(strings.TrimRight(name, "0123456789")):])
+	return index
+}
@@ -0,0 +1,213 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/util"
+)
+
+// /proc/diskstats always counts 512 bytes sectors, regardless of the actual sector size of the device
+const diskstatsSectorSize = 512
+
+type DiskIo struct {
+	ReadMBs     float64 `json:"read_MBs"`
+	WriteMBs    float64 `json:"write_MBs"`
+	ReadIops    float64 `json:"read_iops"`
+	WriteIops   float64 `json:"write_iops"`
+	LatencyMs   float64 `json:"latency_ms"`
+	UtilPercent float64 `json:"util_percent"`
+}
+
+type DiskIoCounters struct {
+	Reads          uint64
+	SectorsRead    uint64
+	ReadTicksMs    uint64
+	Writes         uint64
+	SectorsWritten uint64
+	WriteTicksMs   uint64
+	IoTicksMs      uint64
+}
+
+type DiskIoSnapshot struct {
+	Counters map[string]DiskIoCounters
+	Ts       time.Time
+}
+
+// DiskIoMonitor computes the I/O rates of every block device, from the difference between two readings of /proc/diskstats.
+type DiskIoMonitor struct {
+	snapshot DiskIoSnapshot
+	mu       sync.Mutex
+}
+
+func NewDiskIoMonitor() *DiskIoMonitor {
+	return &DiskIoMonitor{snapshot: newDiskIoSnapshot()}
+}
+
+// ComputeDiskIo returns the rates since the previous call, keyed by device name, e.g. sdb or nvme0n1p1.
+func (monitor *DiskIoMonitor) ComputeDiskIo() map[string]DiskIo {
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	previous := monitor.snapshot
+	snapshot := newDiskIoSnapshot()
+	monitor.snapshot = snapshot
+
+	rates := make(map[string]DiskIo, len(snapshot.Counters))
+
+	deltaTime := snapshot.Ts.Sub(previous.Ts).Seconds()
+	if deltaTime <= 0 {
+		slog.Warn("Disk I/O delta time between snapshots is 0, rates will be returned as 0")
+		return rates
+	}
+
+	diff := func(t0 uint64, t1 uint64) float64 {
+		// counters are reset when the device is removed and added again
+		if t1 < t0 {
+			return 0
+		}
+		return float64(t1 - t0)
+	}
+
+	bytesToMegaBytes := util.SizeConvertionFunction(util.BYTE, util.MEGA)
+	for device, t1 := range snapshot.Counters {
+		t0, exists := previous.Counters[device]
+		if !exists {
+			continue
+		}
+
+		reads := diff(t0.Reads, t1.Reads)
+		writes := diff(t0.Writes, t1.Writes)
+		rate := DiskIo{
+			ReadMBs:     bytesToMegaBytes(diff(t0.SectorsRead, t1.SectorsRead)*diskstatsSectorSize) / deltaTime,
+			WriteMBs:    bytesToMegaBytes(diff(t0.SectorsWritten, t1.SectorsWritten)*diskstatsSectorSize) / deltaTime,
+			ReadIops:    reads / deltaTime,
+			WriteIops:   writes / deltaTime,
+			UtilPercent: min(diff(t0.IoTicksMs, t1.IoTicksMs)/(deltaTime*1000)*100, 100),
+		}
+		if reads+writes > 0 {
+			rate.LatencyMs = (diff(t0.ReadTicksMs, t1.ReadTicksMs) + diff(t0.WriteTicksMs, t1.WriteTicksMs)) / (reads + writes)
+		}
+		rates[device] = rate
+	}
+
+	slog.Debug("Disk I/O rates computed", "devices", len(rates), "delta_time", deltaTime)
+	return rates
+}
+
+func newDiskIoSnapshot() (snapshot DiskIoSnapshot) {
+	snapshot.Ts = time.Now()
+
+	pathToQuery := hostPath("/proc/diskstats")
+	content, err := os.ReadFile(pathToQuery)
+	if err != nil {
+		slog.Error("Disk I/O cannot read diskstats", slog.String("path", pathToQuery), slog.String("error", err.Error()))
+		snapshot.Counters = make(map[string]DiskIoCounters)
+		return
+	}
+
+	snapshot.Counters = parseDiskstats(content)
+	return
+}
+
+// parseDiskstats parses /proc/diskstats, see https://www.kernel.org/doc/Documentation/ABI/testing/procfs-diskstats
+func parseDiskstats(content []byte) map[string]DiskIoCounters {
+	counters := make(map[string]DiskIoCounters)
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 14 {
+			continue
+		}
+
+		values := make([]uint64, len(fields))
+		valid := true
+		for i := 3; i < 14; i++ {
+			value, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				slog.Warn("Disk I/O unable to parse diskstats", "line", scanner.Text())
+				valid = false
+				break
+			}
+			values[i] = value
+		}
+		if !valid {
+			continue
+		}
+
+		counters[fields[2]] = DiskIoCounters{
+			Reads:          values[3],
+			SectorsRead:    values[5],
+			ReadTicksMs:    values[6],
+			Writes:         values[7],
+			SectorsWritten: values[9],
+			WriteTicksMs:   values[10],
+			IoTicksMs:      values[12],
+		}
+	}
+
+	return counters
+}
+
+// readMountDevices maps every mount point of the host to the name of the device mounted there, e.g. /mnt/disks/usb -> sdd1
+func readMountDevices() map[string]string {
+	devices := make(map[string]string)
+
+	pathToQuery := hostPath("/proc/1/mounts")
+	content, err := os.ReadFile(pathToQuery)
+	if err != nil {
+		slog.Error("Disk I/O cannot read mounts", slog.String("path", pathToQuery), slog.String("error", err.Error()))
+		return devices
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		source := fields[0]
+		// device mapper and by-id paths are symlinks to the actual device
+		if resolved, err := filepath.EvalSymlinks(hostPath(source)); err == nil {
+			source = resolved
+		}
+		devices[fields[1]] = filepath.Base(source)
+	}
+
+	return devices
+}
+
+func AggregateDiskIo(ios []*DiskIo) *DiskIo {
+	var total DiskIo
+	latencies := make([]float64, 0, len(ios))
+	found := false
+
+	for _, io := range ios {
+		if io == nil {
+			continue
+		}
+		found = true
+		total.ReadMBs = total.ReadMBs + io.ReadMBs
+		total.WriteMBs = total.WriteMBs + io.WriteMBs
+		total.ReadIops = total.ReadIops + io.ReadIops
+		total.WriteIops = total.WriteIops + io.WriteIops
+		total.UtilPercent = max(total.UtilPercent, io.UtilPercent)
+		if io.LatencyMs > 0 {
+			latencies = append(latencies, io.LatencyMs)
+		}
+	}
+
+	if !found {
+		return nil
+	}
+	total.LatencyMs = util.Average(latencies)
+	return &total
+}
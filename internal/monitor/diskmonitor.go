@@ -2,6 +2,7 @@ package monitor
 
 import (
 	"bufio"
+	"bytes"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -9,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"log/slog"
 
@@ -28,52 +30,105 @@ type Pool struct {
 }
 
 type DiskStatus struct {
-	Name        string  `json:"-"`
-	Path        string  `json:"mount"`
-	Total       float64 `json:"total"`
-	Used        float64 `json:"used"`
-	Free        float64 `json:"free"`
-	UsedPercent float64 `json:"used_percent"`
-	FreePercent float64 `json:"free_percent"`
-	Temp        uint64  `json:"temp"`
-	Id          string  `json:"disk_id"`
-	IsSpinning  bool    `json:"is_spinning"`
+	Name        string            `json:"-"`
+	Path        string            `json:"mount"`
+	Total       float64           `json:"total"`
+	Used        float64           `json:"used"`
+	Free        float64           `json:"free"`
+	UsedPercent float64           `json:"used_percent"`
+	FreePercent float64           `json:"free_percent"`
+	Temp        uint64            `json:"temp"`
+	Id          string            `json:"disk_id"`
+	IsSpinning  bool              `json:"is_spinning"`
+	Status      string            `json:"status"`
+	NumErrors   uint64            `json:"num_errors"`
+	NumReads    uint64            `json:"num_reads"`
+	NumWrites   uint64            `json:"num_writes"`
+	FsType      string            `json:"fs_type"`
+	Rotational  bool              `json:"rotational"`
+	Device      string            `json:"device"`
+	Io          *DiskIo           `json:"io,omitempty"`
+	Smart       *SmartStatus      `json:"smart,omitempty"`
+	Zfs         *ZfsDatasetStatus `json:"zfs,omitempty"`
+	// set by the forecast, based on the history of Used
+	GrowthPerDay    float64    `json:"growth_per_day"`
+	EstimatedFullAt *time.Time `json:"estimated_full_at"`
 }
 
 type ParityStatus struct {
-	Name       string `json:"name"`
-	Temp       uint64 `json:"temp"`
-	Id         string `json:"disk_id"`
-	IsSpinning bool   `json:"is_spinning"`
+	Name       string       `json:"name"`
+	Temp       uint64       `json:"temp"`
+	Id         string       `json:"disk_id"`
+	IsSpinning bool         `json:"is_spinning"`
+	Status     string       `json:"status"`
+	NumErrors  uint64       `json:"num_errors"`
+	NumReads   uint64       `json:"num_reads"`
+	NumWrites  uint64       `json:"num_writes"`
+	Rotational bool         `json:"rotational"`
+	Device     string       `json:"device"`
+	Io         *DiskIo      `json:"io,omitempty"`
+	Smart      *SmartStatus `json:"smart,omitempty"`
 }
 
 type PoolStatus struct {
 	Name  string       `json:"name"`
 	Total DiskStatus   `json:"total"`
 	Disks []DiskStatus `json:"disks"`
+	Btrfs *BtrfsStatus `json:"btrfs,omitempty"`
 }
 
+// Values of the disk status found in disks.ini, any other value is reported as is
+const (
+	DiskOk         = "DISK_OK"
+	DiskDisabled   = "DISK_DSBL"
+	DiskNotPresent = "DISK_NP"
+	DiskInvalid    = "DISK_INVALID"
+)
+
 type DiskIni struct {
-	Id       string
-	Temp     uint64
-	Spundown bool
+	Id         string
+	Temp       uint64
+	Spundown   bool
+	Device     string
+	Status     string
+	NumErrors  uint64
+	NumReads   uint64
+	NumWrites  uint64
+	FsType     string
+	Rotational bool
+	Type       string
+	FsStatus   string
 }
 
 type DiskMonitor struct {
 	pools              []Pool
+	discover           bool
 	checkZfs           bool
+	smart              *SmartMonitor
+	io                 *DiskIoMonitor
 	bytesToCorrectUnit util.MapWithDefault[string, func(float64) float64]
 }
 
 type ZfsDataset struct {
-	Name       string
-	Used       string
-	Avail      string
-	Refer      string
-	Mountpoint string
+	Name          string
+	Used          uint64
+	Avail         uint64
+	Refer         uint64
+	Mountpoint    string
+	CompressRatio float64
+	Quota         uint64
+	Reservation   uint64
+}
+
+type ZfsDatasetStatus struct {
+	Name          string  `json:"name"`
+	Referenced    float64 `json:"referenced"`
+	CompressRatio float64 `json:"compress_ratio"`
+	Quota         float64 `json:"quota"`
+	Reservation   float64 `json:"reservation"`
 }
 
-func NewDiskMonitor(disks map[string][]string, units conf.Units) (dm DiskMonitor) {
+func NewDiskMonitor(disks map[string][]string, units conf.Units, smart *conf.Smart) (dm DiskMonitor) {
 	var conversionFunctionsMap = make(map[string]func(float64) float64)
 
 	conversionFunctionsMap[arrayLabel] = util.SizeConvertionFunction(util.BYTE, units.Array)
@@ -96,17 +151,27 @@ func NewDiskMonitor(disks map[string][]string, units conf.Units) (dm DiskMonitor
 	}
 	dm.pools = pools
 
-	checkZfsString := os.Getenv("ZFS_OK")
-	checkZfsBool, err := strconv.ParseBool(checkZfsString)
+	if len(pools) == 0 {
+		slog.Info("Disk no disks configured, they will be discovered from disks.ini")
+		dm.discover = true
+	}
+
+	checkZfsBool, err := readZfsOk()
 
 	if err != nil {
 		slog.Error("Disk unable to parse env variable as bool",
 			slog.String("variable name", "ZFS_OK"),
-			slog.String("variable value", checkZfsString))
+			slog.String("variable value", os.Getenv("ZFS_OK")))
 	}
 
 	dm.checkZfs = checkZfsBool
 
+	if smart != nil {
+		dm.smart = NewSmartMonitor(smart.Interval)
+	}
+
+	dm.io = NewDiskIoMonitor()
+
 	if checkZfsBool {
 		slog.Info("Running in privileged mode. Will be able to check zfs datasets.")
 	} else {
@@ -116,64 +181,46 @@ func NewDiskMonitor(disks map[string][]string, units conf.Units) (dm DiskMonitor
 }
 
 type DiskUsage struct {
-	Array []DiskStatus
-	Cache []DiskStatus
-	Party []ParityStatus
-	Pools []PoolStatus
+	Array      []DiskStatus
+	Cache      []DiskStatus
+	CacheBtrfs *BtrfsStatus
+	Party      []ParityStatus
+	Pools      []PoolStatus
 }
 
 func (monitor *DiskMonitor) ComputeDiskUsage() DiskUsage {
-	diskIniMap := readDiskIni()
-
-	var wg sync.WaitGroup
-
-	zfsDatasets := monitor.readZfsDatasets()
-
-	computeGroup := func(pool Pool) []DiskStatus {
-		diskChan := make(chan util.IndexedValue[DiskStatus], len(pool.Mounts))
-
-		for i, path := range pool.Mounts {
-			dataset, exists := zfsDatasets[path]
-			if exists {
-				diskChan <- util.IndexedValue[DiskStatus]{
-					Index: i,
-					Value: zfsDatasetUsage(dataset, monitor.bytesToCorrectUnit.Get(pool.Name)),
-				}
-			} else {
-				wg.Add(1)
-				go diskUsage(i, path, monitor.bytesToCorrectUnit.Get(pool.Name), &wg, diskChan)
-			}
-		}
-
-		wg.Wait()
-		close(diskChan)
-
-		disks := make([]DiskStatus, len(pool.Mounts))
-		for disk := range diskChan {
-			diskIni := diskIniMap[disk.Value.Name]
+	return monitor.ComputeSelectedDiskUsage(func(string) bool { return true }, true)
+}
 
-			disk.Value.Id = diskIni.Id
-			disk.Value.Temp = diskIni.Temp
-			disk.Value.IsSpinning = !diskIni.Spundown
+// ComputeSelectedDiskUsage only reads the pools accepted by includePool,
+// and only reads the parity disks if includeParity is set.
+func (monitor *DiskMonitor) ComputeSelectedDiskUsage(includePool func(name string) bool, includeParity bool) DiskUsage {
+	diskIniMap := readDiskIni()
+	if monitor.discover {
+		monitor.updateDiscoveredPools(diskIniMap)
+	}
 
-			disks[disk.Index] = disk.Value
+	pools := make([]Pool, 0, len(monitor.pools))
+	for _, pool := range monitor.pools {
+		if includePool(pool.Name) {
+			pools = append(pools, pool)
+		} else {
+			slog.Debug("Disk skipping pool", "pool", pool.Name)
 		}
+	}
 
-		return disks
+	zfsDatasets := make(map[string]ZfsDataset)
+	if len(pools) > 0 {
+		zfsDatasets = monitor.readZfsDatasets()
 	}
+	lookup := monitor.newDiskLookup()
 
-	poolsStatus := make([]PoolStatus, 0, len(monitor.pools))
+	poolsStatus := make([]PoolStatus, 0, len(pools))
 	var array PoolStatus
 	var cache PoolStatus
 
-	for _, pool := range monitor.pools {
-		disks := computeGroup(pool)
-		total := AggregateDiskStatuses(disks)
-		status := PoolStatus{
-			Name:  pool.Name,
-			Total: total,
-			Disks: disks,
-		}
+	for _, pool := range pools {
+		status := monitor.computePool(pool, diskIniMap, zfsDatasets, lookup)
 		if pool.Name == arrayLabel {
 			array = status
 		} else if pool.Name == cacheLabel {
@@ -183,27 +230,155 @@ func (monitor *DiskMonitor) ComputeDiskUsage() DiskUsage {
 		}
 	}
 
+	parity := make([]ParityStatus, 0)
+	if includeParity {
+		parity = monitor.parityStatuses(diskIniMap, lookup)
+	}
+
+	return DiskUsage{
+		Array:      array.Disks,
+		Cache:      cache.Disks,
+		CacheBtrfs: cache.Btrfs,
+		Pools:      poolsStatus,
+		Party:      parity,
+	}
+}
+
+// diskLookup finds what belongs to a disk besides its usage, reading each source at most once per computation.
+type diskLookup struct {
+	rates            map[string]DiskIo
+	mountDevices     map[string]string
+	btrfsFilesystems map[string]string
+}
+
+func (monitor *DiskMonitor) newDiskLookup() *diskLookup {
+	return &diskLookup{rates: monitor.io.ComputeDiskIo()}
+}
+
+// mountDevice returns the name of the device mounted at the path, e.g. sdb1, or "" if unknown
+func (lookup *diskLookup) mountDevice(mount string) string {
+	if lookup.mountDevices == nil {
+		lookup.mountDevices = readMountDevices()
+	}
+	return lookup.mountDevices[mount]
+}
+
+// io finds the I/O rates of a disk, using the device from disks.ini or, failing that, the device mounted at its path.
+func (lookup *diskLookup) io(device string, mount string) *DiskIo {
+	if io, exists := lookup.rates[device]; exists && device != "" {
+		return &io
+	}
+	if mount == "" {
+		return nil
+	}
+	if io, exists := lookup.rates[lookup.mountDevice(mount)]; exists {
+		return &io
+	}
+	slog.Debug("Disk I/O device not found", "device", device, "mount", mount)
+	return nil
+}
+
+// btrfsUuid returns the uuid of the btrfs filesystem mounted at the path, or "" if it is not btrfs
+func (lookup *diskLookup) btrfsUuid(mount string) string {
+	if lookup.btrfsFilesystems == nil {
+		lookup.btrfsFilesystems = readBtrfsDevices()
+	}
+	return lookup.btrfsFilesystems[lookup.mountDevice(mount)]
+}
+
+func (monitor *DiskMonitor) computePool(pool Pool, diskIniMap map[string]DiskIni, zfsDatasets map[string]ZfsDataset, lookup *diskLookup) PoolStatus {
+	var wg sync.WaitGroup
+	diskChan := make(chan util.IndexedValue[DiskStatus], len(pool.Mounts))
+
+	for i, path := range pool.Mounts {
+		dataset, exists := zfsDatasets[path]
+		if exists {
+			diskChan <- util.IndexedValue[DiskStatus]{
+				Index: i,
+				Value: zfsDatasetUsage(dataset, monitor.bytesToCorrectUnit.Get(pool.Name)),
+			}
+		} else {
+			wg.Add(1)
+			go diskUsage(i, path, monitor.bytesToCorrectUnit.Get(pool.Name), &wg, diskChan)
+		}
+	}
+
+	wg.Wait()
+	close(diskChan)
+
+	disks := make([]DiskStatus, len(pool.Mounts))
+	for disk := range diskChan {
+		diskIni := diskIniMap[disk.Value.Name]
+
+		disk.Value.Id = diskIni.Id
+		disk.Value.Temp = diskIni.Temp
+		disk.Value.IsSpinning = !diskIni.Spundown
+		disk.Value.Status = diskIni.Status
+		disk.Value.NumErrors = diskIni.NumErrors
+		disk.Value.NumReads = diskIni.NumReads
+		disk.Value.NumWrites = diskIni.NumWrites
+		disk.Value.FsType = diskIni.FsType
+		disk.Value.Rotational = diskIni.Rotational
+		disk.Value.Device = diskIni.Device
+		disk.Value.Io = lookup.io(diskIni.Device, disk.Value.Path)
+		if monitor.smart != nil {
+			disk.Value.Smart = monitor.smart.Status(disk.Value.Name, diskIni)
+		}
+
+		disks[disk.Index] = disk.Value
+	}
+
+	status := PoolStatus{
+		Name:  pool.Name,
+		Total: AggregateDiskStatuses(disks),
+		Disks: disks,
+	}
+
+	// the array's disks are separate filesystems, a pool is only reported as btrfs when all of its mounts share the same one
+	uuid := ""
+	for i, path := range pool.Mounts {
+		mountUuid := lookup.btrfsUuid(path)
+		if mountUuid == "" || (i > 0 && mountUuid != uuid) {
+			uuid = ""
+			break
+		}
+		uuid = mountUuid
+	}
+	if uuid != "" {
+		status.Btrfs = readBtrfsStatus(uuid, monitor.bytesToCorrectUnit.Get(pool.Name))
+	}
+
+	return status
+}
+
+func (monitor *DiskMonitor) parityStatuses(diskIniMap map[string]DiskIni, lookup *diskLookup) []ParityStatus {
 	parity := make([]ParityStatus, 0)
 	for name, diskIni := range diskIniMap {
 		if strings.Contains(name, parityLabel) {
-			parity = append(parity, ParityStatus{
+			status := ParityStatus{
 				Name:       name,
 				Temp:       diskIni.Temp,
 				Id:         diskIni.Id,
 				IsSpinning: !diskIni.Spundown,
-			})
+				Status:     diskIni.Status,
+				NumErrors:  diskIni.NumErrors,
+				NumReads:   diskIni.NumReads,
+				NumWrites:  diskIni.NumWrites,
+				Rotational: diskIni.Rotational,
+				Device:     diskIni.Device,
+				Io:         lookup.io(diskIni.Device, ""),
+			}
+			if monitor.smart != nil {
+				status.Smart = monitor.smart.Status(name, diskIni)
+			}
+			parity = append(parity, status)
 		}
 	}
 
 	sort.Slice(parity, func(i, j int) bool {
 		return parity[i].Name < parity[j].Name
 	})
-	return DiskUsage{
-		Array: array.Disks,
-		Cache: cache.Disks,
-		Pools: poolsStatus,
-		Party: parity,
-	}
+	return parity
 }
 
 func diskUsage(
@@ -215,13 +390,7 @@ func diskUsage(
 
 	defer wg.Done()
 
-	var pathToQuery = path
-
-	var hostFsPrefix, isSet = os.LookupEnv("HOSTFS_PREFIX")
-	if isSet {
-		slog.Debug("Disk host prefix is set", "value", hostFsPrefix)
-		pathToQuery = filepath.Join(hostFsPrefix, path)
-	}
+	pathToQuery := hostPath(path)
 	slog.Debug("Disk reading usage", "path", pathToQuery, "original_path", path)
 	usage, err := disk.Usage(pathToQuery)
 
@@ -260,11 +429,9 @@ func diskUsage(
 }
 
 func zfsDatasetUsage(dataset ZfsDataset, bytesToUnit func(float64) float64) DiskStatus {
-	usedBytes, _ := util.ParseZfsSize(dataset.Used)
-	freeBytes, _ := util.ParseZfsSize(dataset.Avail)
-	used := bytesToUnit(usedBytes)
-	free := bytesToUnit(freeBytes)
-	total := usedBytes + freeBytes
+	used := bytesToUnit(float64(dataset.Used))
+	free := bytesToUnit(float64(dataset.Avail))
+	total := used + free
 
 	freePercent := 0.0
 	usedPercent := 0.0
@@ -284,6 +451,13 @@ func zfsDatasetUsage(dataset ZfsDataset, bytesToUnit func(float64) float64) Disk
 		Used:        used,
 		FreePercent: freePercent,
 		UsedPercent: usedPercent,
+		Zfs: &ZfsDatasetStatus{
+			Name:          dataset.Name,
+			Referenced:    bytesToUnit(float64(dataset.Refer)),
+			CompressRatio: dataset.CompressRatio,
+			Quota:         bytesToUnit(float64(dataset.Quota)),
+			Reservation:   bytesToUnit(float64(dataset.Reservation)),
+		},
 	}
 
 	slog.Debug("Disk ZFS dataset status computed", "status", status)
@@ -293,55 +467,75 @@ func zfsDatasetUsage(dataset ZfsDataset, bytesToUnit func(float64) float64) Disk
 
 func (monitor *DiskMonitor) readZfsDatasets() map[string]ZfsDataset {
 
-	zfsDatasets := make(map[string]ZfsDataset)
-
 	if !monitor.checkZfs {
 		slog.Debug("Disk ZFS dataset checking is disabled")
-		return zfsDatasets
+		return make(map[string]ZfsDataset)
 	} else {
 		slog.Debug("Disk ZFS dataset checking is enabled")
 	}
 
-	cmd := exec.Command("zfs", "list")
-	stdout, err := cmd.StdoutPipe()
+	cmd := exec.Command("zfs", "list", "-Hp", "-o", "name,used,avail,refer,mountpoint,compressratio,quota,reservation")
+	output, err := cmd.Output()
 	if err != nil {
-		slog.Error("Disk error while preparing command 'zfs list'", slog.String("error", err.Error()))
-		return zfsDatasets
+		slog.Error("Disk error running command 'zfs list -Hp'", slog.String("error", err.Error()))
+		return make(map[string]ZfsDataset)
 	}
 
-	if err := cmd.Start(); err != nil {
-		slog.Error("Disk error running command 'zfs list'", slog.String("error", err.Error()))
-		return zfsDatasets
-	}
+	return parseZfsList(output)
+}
 
-	outScanner := bufio.NewScanner(stdout)
+// parseZfsList parses the tab separated output of zfs list -Hp, keyed by mountpoint.
+// Unmounted datasets, whose mountpoint is "-", "none" or "legacy", are skipped.
+func parseZfsList(content []byte) map[string]ZfsDataset {
+	zfsDatasets := make(map[string]ZfsDataset)
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 5 {
+			if strings.TrimSpace(scanner.Text()) != "" {
+				slog.Warn("Disk ZFS unable to parse dataset", "line", scanner.Text())
+			}
+			continue
+		}
+
+		// "-" is used for properties that do not apply
+		property := func(index int) string {
+			if index >= len(fields) || fields[index] == "-" {
+				return ""
+			}
+			return fields[index]
+		}
+		number := func(index int) uint64 {
+			value, _ := strconv.ParseUint(property(index), 10, 64)
+			return value
+		}
 
-	outScanner.Scan() // skip header
-	for outScanner.Scan() {
-		fields := strings.Fields(outScanner.Text())
 		ds := ZfsDataset{
-			Name:       fields[0],
-			Used:       fields[1],
-			Avail:      fields[2],
-			Refer:      fields[3],
-			Mountpoint: fields[4],
+			Name:        fields[0],
+			Used:        number(1),
+			Avail:       number(2),
+			Refer:       number(3),
+			Mountpoint:  property(4),
+			Quota:       number(6),
+			Reservation: number(7),
 		}
+		ds.CompressRatio, _ = strconv.ParseFloat(strings.TrimSuffix(property(5), "x"), 64)
+
+		if !strings.HasPrefix(ds.Mountpoint, "/") {
+			slog.Debug("Disk ZFS dataset is not mounted", "dataset", ds.Name)
+			continue
+		}
+
 		slog.Debug("Disk ZFS dataset found", "dataset", ds)
 		zfsDatasets[ds.Mountpoint] = ds
 	}
-	cmd.Wait()
 
 	return zfsDatasets
 }
 
 func readDiskIni() map[string]DiskIni {
-	pathToQuery := "/var/local/emhttp/disks.ini"
-
-	var hostFsPrefix, isSet = os.LookupEnv("HOSTFS_PREFIX")
-	if isSet {
-		slog.Debug("Disk host prefix is set", "value", hostFsPrefix)
-		pathToQuery = filepath.Join(hostFsPrefix, pathToQuery)
-	}
+	pathToQuery := hostPath("/var/local/emhttp/disks.ini")
 
 	diskIniMap := make(map[string]DiskIni)
 
@@ -392,9 +586,18 @@ func readDiskIni() map[string]DiskIni {
 		}
 
 		diskIniMap[sectionName] = DiskIni{
-			Id:       idString.String(),
-			Temp:     temp,
-			Spundown: spunDown.String() == "1",
+			Id:         idString.String(),
+			Temp:       temp,
+			Spundown:   spunDown.String() == "1",
+			Device:     section.Key("device").String(),
+			Status:     section.Key("status").String(),
+			NumErrors:  iniUint(section, "numErrors"),
+			NumReads:   iniUint(section, "numReads"),
+			NumWrites:  iniUint(section, "numWrites"),
+			FsType:     section.Key("fsType").String(),
+			Rotational: section.Key("rotational").String() == "1",
+			Type:       section.Key("type").String(),
+			FsStatus:   section.Key("fsStatus").String(),
 		}
 	}
 
@@ -405,12 +608,17 @@ func AggregateDiskStatuses(disks []DiskStatus) (status DiskStatus) {
 	paths := make([]string, 0, len(disks))
 	temps := make([]float64, 0)
 	ids := make([]string, 0, len(disks))
+	ios := make([]*DiskIo, 0, len(disks))
 	isSpinning := false
 
 	for _, disk := range disks {
 		paths = append(paths, disk.Path)
 		ids = append(ids, disk.Id)
+		ios = append(ios, disk.Io)
 		isSpinning = isSpinning || disk.IsSpinning
+		status.NumErrors = status.NumErrors + disk.NumErrors
+		status.NumReads = status.NumReads + disk.NumReads
+		status.NumWrites = status.NumWrites + disk.NumWrites
 		if disk.Temp > 0 {
 			temps = append(temps, float64(disk.Temp))
 		}
@@ -434,6 +642,7 @@ func AggregateDiskStatuses(disks []DiskStatus) (status DiskStatus) {
 
 	status.Temp = uint64(util.Average(temps))
 	status.IsSpinning = isSpinning
+	status.Io = AggregateDiskIo(ios)
 	status.Id = strings.Join(ids, " ")
 
 	return
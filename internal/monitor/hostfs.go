@@ -0,0 +1,17 @@
+package monitor
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// hostPath prefixes the path with HOSTFS_PREFIX, if set, so that the host's files can be read from within the container.
+func hostPath(path string) string {
+	var hostFsPrefix, isSet = os.LookupEnv("HOSTFS_PREFIX")
+	if isSet {
+		slog.Debug("Host prefix is set", "value", hostFsPrefix)
+		return filepath.Join(hostFsPrefix, path)
+	}
+	return path
+}
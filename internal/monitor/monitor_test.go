@@ -0,0 +1,349 @@
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSmartText(t *testing.T) {
+	content := []byte(`smartctl 7.3 2022-02-28 r5338 [x86_64-linux-6.1.64-Unraid] (local build)
+=== START OF READ SMART DATA SECTION ===
+SMART overall-health self-assessment test result: PASSED
+
+SMART Attributes Data Structure revision number: 16
+Vendor Specific SMART Attributes with Thresholds:
+ID# ATTRIBUTE_NAME          FLAG     VALUE WORST THRESH TYPE      UPDATED  WHEN_FAILED RAW_VALUE
+  1 Raw_Read_Error_Rate     0x002f   200   200   051    Pre-fail  Always       -       0
+  5 Reallocated_Sector_Ct   0x0033   200   200   140    Pre-fail  Always       -       8
+  9 Power_On_Hours          0x0032   062   062   000    Old_age   Always       -       27968
+197 Current_Pending_Sector  0x0032   200   200   000    Old_age   Always       -       2
+199 UDMA_CRC_Error_Count    0x0032   200   200   000    Old_age   Always       -       1
+
+SMART Self-test log structure revision number 1
+Num  Test_Description    Status                  Remaining  LifeTime(hours)  LBA_of_first_error
+# 1  Short offline       Completed without error       00%     27900         -
+# 2  Extended offline    Completed without error       00%     27000         -
+`)
+
+	expected := SmartStatus{
+		Health:             SmartHealthPassed,
+		ReallocatedSectors: 8,
+		PendingSectors:     2,
+		CrcErrors:          1,
+		PowerOnHours:       27968,
+		SelfTest:           "Completed without error",
+	}
+
+	res := parseSmartText(content)
+	if *res != expected {
+		t.Fatalf("expected: %+v, got: %+v", expected, *res)
+	}
+}
+
+func TestParseParityCheckLog(t *testing.T) {
+	content := []byte(`2019 Dec  1 01:00:01|53209|150.3 MB/s|0|0
+2024 Jan 14 03:14:55|82345|97.2 MB/s|-4|3|check P|7814026532
+not a parity check
+`)
+
+	expected := []ParityCheckHistory{
+		{
+			Date:            time.Date(2019, time.December, 1, 1, 0, 1, 0, time.UTC),
+			DurationSeconds: 53209,
+			SpeedMBs:        150.3,
+			ExitCode:        0,
+			Errors:          0,
+		},
+		{
+			Date:            time.Date(2024, time.January, 14, 3, 14, 55, 0, time.UTC),
+			DurationSeconds: 82345,
+			SpeedMBs:        97.2,
+			ExitCode:        -4,
+			Errors:          3,
+			Action:          ParityCheckActionCheck,
+		},
+	}
+
+	res := parseParityCheckLog(content, time.UTC)
+	if len(res) != len(expected) {
+		t.Fatalf("expected %d entries, got: %+v", len(expected), res)
+	}
+	for i := range expected {
+		if res[i] != expected[i] {
+			t.Errorf("expected: %+v, got: %+v", expected[i], res[i])
+		}
+	}
+}
+
+func TestParseDiskstats(t *testing.T) {
+	content := []byte(`   8      16 sdb 1200 10 96000 3400 800 5 64000 1600 0 4100 5000 0 0 0 0
+   8      17 sdb1 1100 10 88000 3000 800 5 64000 1600 0 3900 4600 0 0 0 0
+ 259       0 nvme0n1 50 0 400 10 20 0 160 5 0 12 15
+   7       0 loop0 0 0
+`)
+
+	expected := map[string]DiskIoCounters{
+		"sdb":     {Reads: 1200, SectorsRead: 96000, ReadTicksMs: 3400, Writes: 800, SectorsWritten: 64000, WriteTicksMs: 1600, IoTicksMs: 4100},
+		"sdb1":    {Reads: 1100, SectorsRead: 88000, ReadTicksMs: 3000, Writes: 800, SectorsWritten: 64000, WriteTicksMs: 1600, IoTicksMs: 3900},
+		"nvme0n1": {Reads: 50, SectorsRead: 400, ReadTicksMs: 10, Writes: 20, SectorsWritten: 160, WriteTicksMs: 5, IoTicksMs: 12},
+	}
+
+	res := parseDiskstats(content)
+	if len(res) != len(expected) {
+		t.Fatalf("expected: %+v, got: %+v", expected, res)
+	}
+	for device, counters := range expected {
+		if res[device] != counters {
+			t.Errorf("%s expected: %+v, got: %+v", device, counters, res[device])
+		}
+	}
+}
+
+func TestParseZpoolStatus(t *testing.T) {
+	content := []byte(`  pool: cache
+ state: DEGRADED
+status: One or more devices could not be used because the label is missing or
+	invalid.  Sufficient replicas exist for the pool to continue
+	functioning in a degraded state.
+  scan: scrub in progress since Sun Jan 14 00:24:01 2024
+	1.20T / 3.00T scanned at 500M/s, 800G / 3.00T issued at 300M/s
+	0B repaired, 26.67% done, 1 days 02:00:30 to go
+config:
+
+	NAME         STATE     READ WRITE CKSUM
+	cache        DEGRADED     0     0     0
+	  mirror-0   DEGRADED     0     0     0
+	    nvme0n1  ONLINE       0     0     2
+	    nvme1n1  UNAVAIL      3     1     0
+
+errors: No known data errors
+
+  pool: tank
+ state: ONLINE
+  scan: scrub repaired 0B in 00:10:12 with 0 errors on Sun Jan 14 00:34:13 2024
+config:
+
+	NAME        STATE     READ WRITE CKSUM
+	tank        ONLINE       0     0     0
+	  sda       ONLINE       0     0     0
+
+errors: No known data errors
+`)
+
+	res := parseZpoolStatus(content)
+	if len(res) != 2 {
+		t.Fatalf("expected 2 pools, got: %+v", res)
+	}
+
+	cache := res[0]
+	if cache.Name != "cache" || cache.Health != "DEGRADED" || cache.Errors != "No known data errors" {
+		t.Errorf("unexpected pool: %+v", cache)
+	}
+	expectedScan := ZfsScanStatus{Function: ZfsScanScrub, State: ZfsScanInProgress, Percent: 26.67, EtaSeconds: 93630}
+	cache.Scan.Description = ""
+	if cache.Scan != expectedScan {
+		t.Errorf("expected: %+v, got: %+v", expectedScan, cache.Scan)
+	}
+	expectedVdevs := []ZfsVdevStatus{
+		{Name: "cache", State: "DEGRADED", Depth: 0},
+		{Name: "mirror-0", State: "DEGRADED", Depth: 1},
+		{Name: "nvme0n1", State: "ONLINE", Depth: 2, ChecksumErrors: 2},
+		{Name: "nvme1n1", State: "UNAVAIL", Depth: 2, ReadErrors: 3, WriteErrors: 1},
+	}
+	if len(cache.Vdevs) != len(expectedVdevs) {
+		t.Fatalf("expected: %+v, got: %+v", expectedVdevs, cache.Vdevs)
+	}
+	for i := range expectedVdevs {
+		if cache.Vdevs[i] != expectedVdevs[i] {
+			t.Errorf("expected: %+v, got: %+v", expectedVdevs[i], cache.Vdevs[i])
+		}
+	}
+
+	tank := res[1]
+	tank.Scan.Description = ""
+	expectedScan = ZfsScanStatus{Function: ZfsScanScrub, State: ZfsScanFinished, Percent: 100}
+	if tank.Health != "ONLINE" || len(tank.Vdevs) != 2 || tank.Scan != expectedScan {
+		t.Errorf("unexpected pool: %+v", tank)
+	}
+}
+
+func TestParseZfsList(t *testing.T) {
+	content := []byte("cache\t250000000000\t750000000000\t98304\t/mnt/cache\t1.42\t0\t0\n" +
+		"cache/appdata\t1073741824\t750000000000\t1073741824\t/mnt/cache/appdata\t2.10x\t10737418240\t-\n" +
+		"cache/unmounted\t1024\t750000000000\t1024\t-\t1.00\t0\t0\n" +
+		"cache/short\t1024\n" +
+		"tank/old\t2048\t1000\t2048\t/mnt/tank/old\n")
+
+	expected := map[string]ZfsDataset{
+		"/mnt/cache":         {Name: "cache", Used: 250000000000, Avail: 750000000000, Refer: 98304, Mountpoint: "/mnt/cache", CompressRatio: 1.42},
+		"/mnt/cache/appdata": {Name: "cache/appdata", Used: 1073741824, Avail: 750000000000, Refer: 1073741824, Mountpoint: "/mnt/cache/appdata", CompressRatio: 2.1, Quota: 10737418240},
+		"/mnt/tank/old":      {Name: "tank/old", Used: 2048, Avail: 1000, Refer: 2048, Mountpoint: "/mnt/tank/old"},
+	}
+
+	res := parseZfsList(content)
+	if len(res) != len(expected) {
+		t.Fatalf("expected: %+v, got: %+v", expected, res)
+	}
+	for mountpoint, dataset := range expected {
+		if res[mountpoint] != dataset {
+			t.Errorf("expected: %+v, got: %+v", dataset, res[mountpoint])
+		}
+	}
+}
+
+func TestReadBtrfsStatus(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("HOSTFS_PREFIX", root)
+
+	fsPath := filepath.Join(root, "sys/fs/btrfs/1234-abcd")
+	write := func(path string, content string) {
+		path = filepath.Join(fsPath, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("label", "cache\n")
+	write("allocation/data/total_bytes", "100000")
+	write("allocation/data/bytes_used", "60000")
+	write("allocation/data/disk_total", "200000")
+	write("allocation/data/raid1/total_bytes", "100000")
+	write("allocation/metadata/total_bytes", "2000")
+	write("allocation/metadata/bytes_used", "1000")
+	write("allocation/metadata/disk_total", "4000")
+	write("allocation/metadata/raid1/total_bytes", "2000")
+	write("allocation/system/total_bytes", "100")
+	write("allocation/system/bytes_used", "10")
+	write("allocation/system/disk_total", "200")
+	// 512000 bytes each
+	write("devices/sdb1/size", "1000")
+	write("devices/sdc1/size", "1000")
+	write("devinfo/1/missing", "0")
+	write("devinfo/1/error_stats", "write_errs 1\nread_errs 2\nflush_errs 0\ncorruption_errs 3\ngeneration_errs 0\n")
+	write("devinfo/2/missing", "1")
+
+	devices := readBtrfsDevices()
+	if devices["sdb1"] != "1234-abcd" || devices["sdc1"] != "1234-abcd" {
+		t.Fatalf("unexpected devices: %+v", devices)
+	}
+
+	res := readBtrfsStatus("1234-abcd", func(value float64) float64 { return value })
+	if res.Label != "cache" || res.DataProfile != "raid1" || res.MetadataProfile != "raid1" {
+		t.Errorf("unexpected status: %+v", res)
+	}
+	expectedData := BtrfsAllocation{Total: 100000, Used: 60000, RawTotal: 200000}
+	if res.Data != expectedData {
+		t.Errorf("expected: %+v, got: %+v", expectedData, res.Data)
+	}
+	// 1024000 - 204200 unallocated, halved by raid1, plus the 40000 free in the data chunks
+	if res.Unallocated != 819800 || res.FreeEstimated != 449900 {
+		t.Errorf("unexpected free space, unallocated: %f, free estimated: %f", res.Unallocated, res.FreeEstimated)
+	}
+	expectedDevices := []BtrfsDeviceStatus{
+		{Devid: "1", WriteErrors: 1, ReadErrors: 2, CorruptionErrors: 3},
+		{Devid: "2", Missing: true},
+	}
+	if len(res.Devices) != len(expectedDevices) {
+		t.Fatalf("expected: %+v, got: %+v", expectedDevices, res.Devices)
+	}
+	for i := range expectedDevices {
+		if res.Devices[i] != expectedDevices[i] {
+			t.Errorf("expected: %+v, got: %+v", expectedDevices[i], res.Devices[i])
+		}
+	}
+}
+
+func TestDiscoverPools(t *testing.T) {
+	diskIniMap := map[string]DiskIni{
+		"parity": {Type: "Parity", Status: DiskOk, FsStatus: "-"},
+		"disk1":  {Type: "Data", Status: DiskOk, FsStatus: "Mounted"},
+		"disk2":  {Type: "Data", Status: DiskNotPresent, FsStatus: "Unmounted"},
+		"disk10": {Type: "Data", Status: DiskOk, FsStatus: "Mounted"},
+		"disk3":  {Type: "Data", Status: DiskDisabled, FsStatus: "Mounted"},
+		"cache":  {Type: "Cache", Status: DiskOk, FsStatus: "Mounted"},
+		"cache2": {Type: "Cache", Status: DiskOk},
+		"fast":   {Type: "Cache", Status: DiskOk, FsStatus: "Mounted"},
+		"pool2":  {Type: "Cache", Status: DiskOk, FsStatus: "Mounted"},
+		"flash":  {Type: "Flash", Status: DiskOk, FsStatus: "Mounted"},
+	}
+
+	expected := []Pool{
+		{Name: "array", Mounts: []string{"/mnt/disk1", "/mnt/disk3", "/mnt/disk10"}},
+		{Name: "cache", Mounts: []string{"/mnt/cache"}},
+		{Name: "fast", Mounts: []string{"/mnt/fast"}},
+		{Name: "pool2", Mounts: []string{"/mnt/pool2"}},
+	}
+
+	res := discoverPools(diskIniMap)
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("expected: %+v, got: %+v", expected, res)
+	}
+}
+
+func TestShareEligibility(t *testing.T) {
+	sharesIni := `["appdata"]
+name="appdata"
+useCache="only"
+cachePool="cache"
+["media"]
+name="media"
+comment="movies"
+include="disk1,disk2"
+exclude=""
+useCache="yes"
+cachePool="fast"
+["backups"]
+name="backups"
+include=""
+exclude="disk2"
+useCache="no"
+cachePool="cache"
+`
+	prefix := t.TempDir()
+	emhttp := filepath.Join(prefix, "var", "local", "emhttp")
+	if err := os.MkdirAll(emhttp, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(emhttp, "shares.ini"), []byte(sharesIni), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOSTFS_PREFIX", prefix)
+
+	shares := make(map[string]shareIni)
+	for _, share := range readSharesIni() {
+		shares[share.Name] = share
+	}
+	if media := shares["media"]; media.Comment != "movies" || !reflect.DeepEqual(media.Include, []string{"disk1", "disk2"}) || len(media.Exclude) != 0 {
+		t.Fatalf("unexpected share: %+v", media)
+	}
+
+	cases := []struct {
+		share    string
+		pool     string
+		disk     string
+		eligible bool
+	}{
+		{"appdata", "array", "disk1", false},
+		{"appdata", "cache", "cache", true},
+		{"appdata", "fast", "fast", false},
+		{"media", "array", "disk1", true},
+		{"media", "array", "disk3", false},
+		{"media", "fast", "fast", true},
+		{"media", "cache", "cache", false},
+		{"backups", "array", "disk1", true},
+		{"backups", "array", "disk2", false},
+		{"backups", "cache", "cache", false},
+	}
+	for _, c := range cases {
+		share := shares[c.share]
+		if eligible := share.eligiblePool(c.pool) && share.eligibleDisk(c.pool, c.disk); eligible != c.eligible {
+			t.Errorf("%s on %s/%s: expected %v, got %v", c.share, c.pool, c.disk, c.eligible, eligible)
+		}
+	}
+}
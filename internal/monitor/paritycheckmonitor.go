@@ -0,0 +1,201 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/util"
+)
+
+const (
+	ParityCheckActionCheck   = "check"
+	ParityCheckActionRebuild = "rebuild"
+	ParityCheckActionClear   = "clear"
+)
+
+const parityCheckLogPath = "/boot/config/parity-checks.log"
+const parityCheckLogDateLayout = "2006 Jan _2 15:04:05"
+
+type ParityCheckStatus struct {
+	Running    bool                 `json:"running"`
+	Action     string               `json:"action"`
+	Correcting bool                 `json:"correcting"`
+	Percent    float64              `json:"percent"`
+	SpeedMBs   float64              `json:"speed_MBs"`
+	EtaSeconds uint64               `json:"eta_seconds"`
+	Errors     uint64               `json:"errors"`
+	LastCheck  *ParityCheckHistory  `json:"last_check"`
+	History    []ParityCheckHistory `json:"history"`
+}
+
+type ParityCheckHistory struct {
+	Date            time.Time `json:"date"`
+	DaysAgo         int       `json:"days_ago"`
+	DurationSeconds uint64    `json:"duration_seconds"`
+	SpeedMBs        float64   `json:"speed_MBs"`
+	ExitCode        int       `json:"exit_code"`
+	Errors          uint64    `json:"errors"`
+	Action          string    `json:"action"`
+}
+
+// ParityCheckMonitor reads the progress of a running parity check, rebuild or clear from var.ini,
+// and the history of the past ones from parity-checks.log, which is only parsed again when modified.
+type ParityCheckMonitor struct {
+	history        []ParityCheckHistory
+	historyModTime time.Time
+	mu             sync.Mutex
+}
+
+func NewParityCheckMonitor() *ParityCheckMonitor {
+	return &ParityCheckMonitor{}
+}
+
+func (monitor *ParityCheckMonitor) ComputeParityCheckStatus() (status ParityCheckStatus) {
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	varIni, err := readVarIni()
+	if err != nil {
+		slog.Error("Parity check unable to read var.ini", slog.String("error", err.Error()))
+	} else {
+		size := iniUint(varIni, "mdResyncSize")
+		position := iniUint(varIni, "mdResyncPos")
+		deltaBlocks := iniUint(varIni, "mdResyncDb")
+		deltaTime := iniUint(varIni, "mdResyncDt")
+
+		status.Running = iniUint(varIni, "mdResync") > 0 && position > 0
+		status.Errors = iniUint(varIni, "sbSyncErrs")
+
+		if status.Running {
+			status.Action = parityCheckAction(varIni.Key("mdResyncAction").String())
+			status.Correcting = iniUint(varIni, "mdResyncCorr") == 1
+			if size > 0 {
+				status.Percent = float64(position) / float64(size) * 100
+			}
+			if deltaTime > 0 && deltaBlocks > 0 {
+				// positions and deltas are in 1KiB blocks
+				kibPerSecond := float64(deltaBlocks) / float64(deltaTime)
+				status.SpeedMBs = util.SizeConvertionFunction(util.KIBI, util.MEGA)(kibPerSecond)
+				if size > position {
+					status.EtaSeconds = uint64(float64(size-position) / kibPerSecond)
+				}
+			}
+		}
+	}
+
+	status.History = monitor.readHistory()
+	if len(status.History) > 0 {
+		last := status.History[len(status.History)-1]
+		status.LastCheck = &last
+	}
+
+	slog.Debug("Parity check status computed", "running", status.Running, "percent", status.Percent)
+	return
+}
+
+// parityCheckAction turns mdResyncAction, e.g. "check P Q" or "recon P", into one of the ParityCheckAction values
+func parityCheckAction(mdResyncAction string) string {
+	fields := strings.Fields(mdResyncAction)
+	if len(fields) == 0 {
+		return ""
+	}
+	switch fields[0] {
+	case "check":
+		return ParityCheckActionCheck
+	case "recon":
+		return ParityCheckActionRebuild
+	case "clear":
+		return ParityCheckActionClear
+	}
+	return fields[0]
+}
+
+func (monitor *ParityCheckMonitor) readHistory() []ParityCheckHistory {
+	path := hostPath(parityCheckLogPath)
+	info, err := os.Stat(path)
+	if err != nil {
+		slog.Debug("Parity check unable to read history", "path", path, "error", err.Error())
+		return make([]ParityCheckHistory, 0)
+	}
+
+	if !info.ModTime().Equal(monitor.historyModTime) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			slog.Error("Parity check unable to read history", slog.String("path", path), slog.String("error", err.Error()))
+			return make([]ParityCheckHistory, 0)
+		}
+		monitor.history = parseParityCheckLog(content, time.Local)
+		monitor.historyModTime = info.ModTime()
+	}
+
+	history := make([]ParityCheckHistory, len(monitor.history))
+	now := time.Now()
+	for i, entry := range monitor.history {
+		entry.DaysAgo = int(now.Sub(entry.Date).Hours() / 24)
+		history[i] = entry
+	}
+	return history
+}
+
+// parseParityCheckLog parses lines such as "2024 Jan  7 03:14:55|82345|97.2 MB/s|0|0|check P|7814026532",
+// older versions of Unraid only wrote the first five fields.
+func parseParityCheckLog(content []byte, location *time.Location) []ParityCheckHistory {
+	history := make([]ParityCheckHistory, 0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Split(line, "|")
+		if len(fields) < 5 {
+			if line != "" {
+				slog.Warn("Parity check unable to parse history line", "line", line)
+			}
+			continue
+		}
+
+		date, err := time.ParseInLocation(parityCheckLogDateLayout, strings.Join(strings.Fields(fields[0]), " "), location)
+		if err != nil {
+			date, err = time.ParseInLocation(parityCheckLogDateLayout, fields[0], location)
+		}
+		if err != nil {
+			slog.Warn("Parity check unable to parse history date", "date", fields[0])
+			continue
+		}
+
+		entry := ParityCheckHistory{Date: date}
+		entry.DurationSeconds, _ = strconv.ParseUint(fields[1], 10, 64)
+		entry.SpeedMBs = parseParityCheckSpeed(fields[2])
+		entry.ExitCode, _ = strconv.Atoi(fields[3])
+		entry.Errors, _ = strconv.ParseUint(fields[4], 10, 64)
+		if len(fields) > 5 {
+			entry.Action = parityCheckAction(fields[5])
+		}
+
+		history = append(history, entry)
+	}
+
+	return history
+}
+
+// parseParityCheckSpeed parses speeds such as "97.2 MB/s" or "1.1 GB/s", returning MB/s
+func parseParityCheckSpeed(speed string) float64 {
+	fields := strings.Fields(speed)
+	if len(fields) != 2 {
+		return 0
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+	unit := strings.TrimSuffix(fields[1], "B/s")
+	if unit == "" {
+		unit = util.BYTE
+	}
+	return util.SizeConvertionFunction(unit, util.MEGA)(value)
+}
@@ -0,0 +1,284 @@
+package monitor
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/util"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	ShareUseCacheYes    = "yes"
+	ShareUseCachePrefer = "prefer"
+	ShareUseCacheOnly   = "only"
+	ShareUseCacheNo     = "no"
+)
+
+type ShareStatus struct {
+	Name          string     `json:"name"`
+	Comment       string     `json:"comment"`
+	Size          float64    `json:"size"`
+	Free          float64    `json:"free"`
+	Include       []string   `json:"include"`
+	Exclude       []string   `json:"exclude"`
+	UseCache      string     `json:"use_cache"`
+	CachePool     string     `json:"cache_pool"`
+	SplitLevel    string     `json:"split_level"`
+	Allocator     string     `json:"allocator"`
+	Disks         []string   `json:"disks"`
+	SizeUpdatedAt *time.Time `json:"size_updated_at"`
+}
+
+type shareIni struct {
+	Name       string
+	Comment    string
+	Include    []string
+	Exclude    []string
+	UseCache   string
+	CachePool  string
+	SplitLevel string
+	Allocator  string
+}
+
+// ShareMonitor reports the user shares, and which disks hold their data.
+// Sizes require walking every file of the shares, which is done in the background at most once per interval
+// and never on spun down disks, whose last known size is kept.
+type ShareMonitor struct {
+	sizeInterval       time.Duration
+	bytesToCorrectUnit func(float64) float64
+	poolToBytes        util.MapWithDefault[string, func(float64) float64]
+
+	mu sync.Mutex
+	// mount -> share names found at its root
+	diskShares map[string][]string
+	// mount -> share -> bytes
+	diskSizes     map[string]map[string]uint64
+	sizeUpdatedAt time.Time
+	walking       bool
+}
+
+func NewShareMonitor(units conf.Units, shares *conf.Shares) *ShareMonitor {
+	monitor := &ShareMonitor{
+		bytesToCorrectUnit: util.SizeConvertionFunction(util.BYTE, units.Array),
+		poolToBytes: util.NewMapWithDefault(
+			map[string]func(float64) float64{
+				arrayLabel: util.SizeConvertionFunction(units.Array, util.BYTE),
+				cacheLabel: util.SizeConvertionFunction(units.Cache, util.BYTE),
+			},
+			util.SizeConvertionFunction(units.Pools, util.BYTE),
+		),
+		diskShares: make(map[string][]string),
+		diskSizes:  make(map[string]map[string]uint64),
+	}
+	if shares != nil {
+		monitor.sizeInterval = shares.SizeInterval
+		slog.Info("Shares sizes will be computed", "interval", shares.SizeInterval)
+	}
+	return monitor
+}
+
+// ComputeShares describes every share, the pools being the array, the cache and the additional pools as last computed.
+func (monitor *ShareMonitor) ComputeShares(pools []PoolStatus) []ShareStatus {
+	sharesIni := readSharesIni()
+
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	toWalk := make([]string, 0)
+	for _, pool := range pools {
+		for _, disk := range pool.Disks {
+			if !disk.IsSpinning {
+				slog.Debug("Shares disk is spun down, using its last known shares", "disk", disk.Name)
+				continue
+			}
+			monitor.diskShares[disk.Path] = readDiskShares(disk.Path)
+			toWalk = append(toWalk, disk.Path)
+		}
+	}
+
+	if monitor.sizeInterval > 0 && !monitor.walking && time.Since(monitor.sizeUpdatedAt) >= monitor.sizeInterval {
+		monitor.walking = true
+		go monitor.walkSizes(toWalk)
+	}
+
+	shares := make([]ShareStatus, 0, len(sharesIni))
+	for _, share := range sharesIni {
+		status := ShareStatus{
+			Name:       share.Name,
+			Comment:    share.Comment,
+			Include:    share.Include,
+			Exclude:    share.Exclude,
+			UseCache:   share.UseCache,
+			CachePool:  share.CachePool,
+			SplitLevel: share.SplitLevel,
+			Allocator:  share.Allocator,
+			Disks:      make([]string, 0),
+		}
+
+		var sizeBytes, freeBytes uint64
+		for _, pool := range pools {
+			eligible := share.eligiblePool(pool.Name)
+			toBytes := monitor.poolToBytes.Get(pool.Name)
+			for _, disk := range pool.Disks {
+				if eligible && share.eligibleDisk(pool.Name, disk.Name) {
+					freeBytes = freeBytes + uint64(toBytes(disk.Free))
+				}
+				for _, name := range monitor.diskShares[disk.Path] {
+					if name == share.Name {
+						status.Disks = append(status.Disks, disk.Name)
+					}
+				}
+				sizeBytes = sizeBytes + monitor.diskSizes[disk.Path][share.Name]
+			}
+		}
+
+		status.Free = monitor.bytesToCorrectUnit(float64(freeBytes))
+		if !monitor.sizeUpdatedAt.IsZero() {
+			status.Size = monitor.bytesToCorrectUnit(float64(sizeBytes))
+			updatedAt := monitor.sizeUpdatedAt
+			status.SizeUpdatedAt = &updatedAt
+		}
+		shares = append(shares, status)
+	}
+
+	slog.Debug("Shares computed", "shares", len(shares))
+	return shares
+}
+
+func (monitor *ShareMonitor) walkSizes(mounts []string) {
+	slog.Debug("Shares computing sizes", "disks", mounts)
+	start := time.Now()
+
+	sizes := make(map[string]map[string]uint64, len(mounts))
+	for _, mount := range mounts {
+		sizes[mount] = make(map[string]uint64)
+		for _, share := range readDiskShares(mount) {
+			sizes[mount][share] = directorySize(hostPath(filepath.Join(mount, share)))
+		}
+	}
+
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+	for mount, shareSizes := range sizes {
+		monitor.diskSizes[mount] = shareSizes
+	}
+	monitor.sizeUpdatedAt = time.Now()
+	monitor.walking = false
+	slog.Info("Shares sizes computed", "duration", time.Since(start))
+}
+
+func directorySize(path string) (size uint64) {
+	filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			slog.Debug("Shares unable to walk", "path", path, "error", err.Error())
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				size = size + uint64(info.Size())
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// readDiskShares lists the directories at the root of a disk, each of them being part of the share with the same name
+func readDiskShares(mount string) []string {
+	shares := make([]string, 0)
+	entries, err := os.ReadDir(hostPath(mount))
+	if err != nil {
+		slog.Debug("Shares unable to read disk", "mount", mount, "error", err.Error())
+		return shares
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			shares = append(shares, entry.Name())
+		}
+	}
+	return shares
+}
+
+// eligiblePool tells whether new files of the share can be written to the pool
+func (share shareIni) eligiblePool(pool string) bool {
+	switch pool {
+	case arrayLabel:
+		return share.UseCache != ShareUseCacheOnly
+	case share.CachePool:
+		return share.UseCache != ShareUseCacheNo
+	}
+	return false
+}
+
+// eligibleDisk applies the included and excluded disks of the share, which only concern the array
+func (share shareIni) eligibleDisk(pool string, disk string) bool {
+	if pool != arrayLabel {
+		return true
+	}
+	for _, excluded := range share.Exclude {
+		if excluded == disk {
+			return false
+		}
+	}
+	if len(share.Include) == 0 {
+		return true
+	}
+	for _, included := range share.Include {
+		if included == disk {
+			return true
+		}
+	}
+	return false
+}
+
+func readSharesIni() []shareIni {
+	pathToQuery := hostPath("/var/local/emhttp/shares.ini")
+
+	sharesFile, err := ini.Load(pathToQuery)
+	if err != nil {
+		slog.Error("Shares unable to read shares.ini", slog.String("error", err.Error()))
+		return make([]shareIni, 0)
+	}
+
+	splitList := func(value string) []string {
+		list := make([]string, 0)
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				list = append(list, element)
+			}
+		}
+		return list
+	}
+
+	shares := make([]shareIni, 0)
+	for _, section := range sharesFile.Sections() {
+		if section.Name() == ini.DefaultSection {
+			continue
+		}
+
+		name := section.Key("name").String()
+		if name == "" {
+			name = strings.Trim(section.Name(), "\"")
+		}
+
+		shares = append(shares, shareIni{
+			Name:       name,
+			Comment:    section.Key("comment").String(),
+			Include:    splitList(section.Key("include").String()),
+			Exclude:    splitList(section.Key("exclude").String()),
+			UseCache:   section.Key("useCache").String(),
+			CachePool:  section.Key("cachePool").String(),
+			SplitLevel: section.Key("splitLevel").String(),
+			Allocator:  section.Key("allocator").String(),
+		})
+	}
+
+	return shares
+}
@@ -0,0 +1,257 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SmartHealthPassed  = "PASSED"
+	SmartHealthFailed  = "FAILED"
+	SmartHealthUnknown = "UNKNOWN"
+)
+
+const (
+	reallocatedSectorsAttribute = 5
+	powerOnHoursAttribute       = 9
+	pendingSectorsAttribute     = 197
+	crcErrorsAttribute          = 199
+)
+
+type SmartStatus struct {
+	Health             string    `json:"health"`
+	ReallocatedSectors uint64    `json:"reallocated_sectors"`
+	PendingSectors     uint64    `json:"pending_sectors"`
+	CrcErrors          uint64    `json:"crc_errors"`
+	PowerOnHours       uint64    `json:"power_on_hours"`
+	SelfTest           string    `json:"self_test"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+// SmartMonitor caches the SMART data of every disk, refreshing it at most once per interval.
+// Spun down disks are never queried, so that they are not woken up, their last known data is served instead.
+type SmartMonitor struct {
+	interval    time.Duration
+	useSmartctl bool
+	cache       map[string]SmartStatus
+	mu          sync.Mutex
+}
+
+func NewSmartMonitor(interval time.Duration) *SmartMonitor {
+	monitor := &SmartMonitor{
+		interval: interval,
+		cache:    make(map[string]SmartStatus),
+	}
+
+	if _, err := exec.LookPath("smartctl"); err == nil {
+		slog.Info("SMART data will be read using smartctl")
+		monitor.useSmartctl = true
+	} else {
+		slog.Info("SMART smartctl not found, data will be read from Unraid's cached files")
+	}
+
+	return monitor
+}
+
+// Status returns the SMART data of the named disk, or nil if it has never been read.
+func (monitor *SmartMonitor) Status(name string, diskIni DiskIni) *SmartStatus {
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	cached, isCached := monitor.cache[name]
+	if isCached && (diskIni.Spundown || time.Since(cached.UpdatedAt) < monitor.interval) {
+		return &cached
+	}
+	if diskIni.Spundown {
+		slog.Debug("SMART disk is spun down and has no cached data", "disk", name)
+		return nil
+	}
+
+	var status *SmartStatus
+	if monitor.useSmartctl {
+		status = readSmartctl(diskIni.Device)
+	} else {
+		status = readSmartFile(name)
+	}
+
+	if status == nil {
+		if isCached {
+			return &cached
+		}
+		return nil
+	}
+
+	status.UpdatedAt = time.Now()
+	monitor.cache[name] = *status
+	slog.Debug("SMART status read", "disk", name, "status", status)
+	return status
+}
+
+type smartctlOutput struct {
+	Smartctl struct {
+		ExitStatus int `json:"exit_status"`
+	} `json:"smartctl"`
+	SmartStatus *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	PowerOnTime struct {
+		Hours uint64 `json:"hours"`
+	} `json:"power_on_time"`
+	AtaSmartAttributes struct {
+		Table []struct {
+			Id  int `json:"id"`
+			Raw struct {
+				Value uint64 `json:"value"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	AtaSmartSelfTestLog struct {
+		Standard struct {
+			Table []struct {
+				Status struct {
+					String string `json:"string"`
+				} `json:"status"`
+			} `json:"table"`
+		} `json:"standard"`
+	} `json:"ata_smart_self_test_log"`
+	NvmeSmartHealthInformationLog *struct {
+		MediaErrors uint64 `json:"media_errors"`
+	} `json:"nvme_smart_health_information_log"`
+}
+
+// smartctl exit status bits meaning that no data could be read, see man smartctl
+const smartctlFatalBits = 0b111
+
+func readSmartctl(device string) *SmartStatus {
+	if device == "" {
+		return nil
+	}
+
+	// -n standby makes smartctl bail out instead of spinning up a disk that went to sleep in the meantime
+	cmd := exec.Command("smartctl", "--json", "-a", "-n", "standby", filepath.Join("/dev", device))
+	output, err := cmd.Output()
+	if err != nil {
+		if _, isExitError := err.(*exec.ExitError); !isExitError {
+			slog.Error("SMART unable to run smartctl", slog.String("device", device), slog.String("error", err.Error()))
+			return nil
+		}
+	}
+
+	var parsed smartctlOutput
+	if err := json.Unmarshal(output, &parsed); err != nil {
+		slog.Error("SMART unable to parse smartctl output", slog.String("device", device), slog.String("error", err.Error()))
+		return nil
+	}
+
+	if parsed.Smartctl.ExitStatus&smartctlFatalBits != 0 {
+		slog.Debug("SMART smartctl could not read the device", "device", device, "exit status", parsed.Smartctl.ExitStatus)
+		return nil
+	}
+
+	status := SmartStatus{
+		Health:       SmartHealthUnknown,
+		PowerOnHours: parsed.PowerOnTime.Hours,
+	}
+
+	if parsed.SmartStatus != nil {
+		if parsed.SmartStatus.Passed {
+			status.Health = SmartHealthPassed
+		} else {
+			status.Health = SmartHealthFailed
+		}
+	}
+
+	for _, attribute := range parsed.AtaSmartAttributes.Table {
+		switch attribute.Id {
+		case reallocatedSectorsAttribute:
+			status.ReallocatedSectors = attribute.Raw.Value
+		case pendingSectorsAttribute:
+			status.PendingSectors = attribute.Raw.Value
+		case crcErrorsAttribute:
+			status.CrcErrors = attribute.Raw.Value
+		}
+	}
+
+	if parsed.NvmeSmartHealthInformationLog != nil {
+		status.ReallocatedSectors = parsed.NvmeSmartHealthInformationLog.MediaErrors
+	}
+
+	if selfTests := parsed.AtaSmartSelfTestLog.Standard.Table; len(selfTests) > 0 {
+		status.SelfTest = selfTests[0].Status.String
+	}
+
+	return &status
+}
+
+var smartAttributeRegex = regexp.MustCompile(`^\s*(\d+)\s+\S+\s+0x[0-9a-fA-F]+\s+\d+\s+\d+\s+\S+\s+\S+\s+\S+\s+\S+\s+(\d+)`)
+var smartHealthRegex = regexp.MustCompile(`(?:overall-health self-assessment test result|SMART Health Status):\s*(\S+)`)
+var smartSelfTestRegex = regexp.MustCompile(`^# ?1\s+\S+(?: \S+)*?\s{2,}(.+?)\s{2,}`)
+
+// readSmartFile parses the smartctl output cached by Unraid in /var/local/emhttp/smart
+func readSmartFile(name string) *SmartStatus {
+	path := hostPath(filepath.Join("/var/local/emhttp/smart", name))
+	content, err := os.ReadFile(path)
+	if err != nil {
+		slog.Debug("SMART unable to read cached file", "path", path, "error", err.Error())
+		return nil
+	}
+
+	return parseSmartText(content)
+}
+
+func parseSmartText(content []byte) *SmartStatus {
+	status := SmartStatus{Health: SmartHealthUnknown}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if res := smartHealthRegex.FindStringSubmatch(line); len(res) > 1 {
+			switch strings.ToUpper(res[1]) {
+			case SmartHealthPassed, "OK":
+				status.Health = SmartHealthPassed
+			default:
+				status.Health = SmartHealthFailed
+			}
+			continue
+		}
+
+		if res := smartSelfTestRegex.FindStringSubmatch(line); len(res) > 1 {
+			status.SelfTest = strings.TrimSpace(res[1])
+			continue
+		}
+
+		res := smartAttributeRegex.FindStringSubmatch(line)
+		if len(res) < 3 {
+			continue
+		}
+		id, _ := strconv.Atoi(res[1])
+		value, err := strconv.ParseUint(res[2], 10, 64)
+		if err != nil {
+			slog.Warn("SMART unable to parse attribute", "line", line)
+			continue
+		}
+		switch id {
+		case reallocatedSectorsAttribute:
+			status.ReallocatedSectors = value
+		case powerOnHoursAttribute:
+			status.PowerOnHours = value
+		case pendingSectorsAttribute:
+			status.PendingSectors = value
+		case crcErrorsAttribute:
+			status.CrcErrors = value
+		}
+	}
+
+	return &status
+}
@@ -0,0 +1,34 @@
+package monitor
+
+import (
+	"log/slog"
+	"strconv"
+
+	"gopkg.in/ini.v1"
+)
+
+// readVarIni reads Unraid's var.ini, whose keys are not grouped in any section.
+func readVarIni() (*ini.Section, error) {
+	pathToQuery := hostPath("/var/local/emhttp/var.ini")
+
+	varIni, err := ini.Load(pathToQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	return varIni.Section(ini.DefaultSection), nil
+}
+
+// iniUint parses the value of the key, 0 if missing or malformed
+func iniUint(section *ini.Section, key string) uint64 {
+	value := section.Key(key).String()
+	if value == "" {
+		return 0
+	}
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		slog.Warn("Unable to parse ini value", "key", key, "value", value)
+		return 0
+	}
+	return parsed
+}
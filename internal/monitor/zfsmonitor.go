@@ -0,0 +1,320 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/util"
+)
+
+const (
+	ZfsScanScrub    = "scrub"
+	ZfsScanResilver = "resilver"
+
+	ZfsScanNone       = "none"
+	ZfsScanInProgress = "in_progress"
+	ZfsScanPaused     = "paused"
+	ZfsScanFinished   = "finished"
+	ZfsScanCanceled   = "canceled"
+)
+
+type ZfsStatus struct {
+	Pools []ZfsPoolStatus `json:"pools"`
+	Arc   *ZfsArcStatus   `json:"arc"`
+}
+
+type ZfsPoolStatus struct {
+	Name                 string          `json:"name"`
+	Health               string          `json:"health"`
+	Total                float64         `json:"total"`
+	Used                 float64         `json:"used"`
+	Free                 float64         `json:"free"`
+	UsedPercent          float64         `json:"used_percent"`
+	FragmentationPercent float64         `json:"fragmentation_percent"`
+	Scan                 ZfsScanStatus   `json:"scan"`
+	Vdevs                []ZfsVdevStatus `json:"vdevs"`
+	Errors               string          `json:"errors"`
+}
+
+// ZfsVdevStatus is a line of the config section of zpool status, depth 0 being the pool itself
+type ZfsVdevStatus struct {
+	Name           string `json:"name"`
+	State          string `json:"state"`
+	Depth          int    `json:"depth"`
+	ReadErrors     uint64 `json:"read_errors"`
+	WriteErrors    uint64 `json:"write_errors"`
+	ChecksumErrors uint64 `json:"checksum_errors"`
+}
+
+type ZfsScanStatus struct {
+	Function    string  `json:"function"`
+	State       string  `json:"state"`
+	Percent     float64 `json:"percent"`
+	EtaSeconds  uint64  `json:"eta_seconds"`
+	Errors      uint64  `json:"errors"`
+	Description string  `json:"description"`
+}
+
+type ZfsArcStatus struct {
+	Size            float64 `json:"size"`
+	TargetSize      float64 `json:"target_size"`
+	MaxSize         float64 `json:"max_size"`
+	Hits            uint64  `json:"hits"`
+	Misses          uint64  `json:"misses"`
+	HitRatioPercent float64 `json:"hit_ratio_percent"`
+}
+
+// ZfsMonitor reports the health of the ZFS pools, which requires the container to be privileged, and the ARC statistics.
+type ZfsMonitor struct {
+	checkZpool         bool
+	bytesToCorrectUnit util.MapWithDefault[string, func(float64) float64]
+	bytesToMemoryUnit  func(float64) float64
+}
+
+func NewZfsMonitor(units conf.Units) (zm ZfsMonitor) {
+	zm.bytesToCorrectUnit = util.NewMapWithDefault(
+		map[string]func(float64) float64{cacheLabel: util.SizeConvertionFunction(util.BYTE, units.Cache)},
+		util.SizeConvertionFunction(util.BYTE, units.Pools),
+	)
+	zm.bytesToMemoryUnit = util.SizeConvertionFunction(util.BYTE, units.Memory)
+
+	checkZpool, err := readZfsOk()
+	if err != nil {
+		slog.Error("ZFS unable to parse env variable as bool", slog.String("variable name", "ZFS_OK"), slog.String("error", err.Error()))
+	}
+	zm.checkZpool = checkZpool
+	if !checkZpool {
+		slog.Info("ZFS not running in privileged mode, pool health will not be available")
+	}
+	return
+}
+
+// readZfsOk reads the ZFS_OK variable set by the entrypoint when zfs commands can be run
+func readZfsOk() (bool, error) {
+	return strconv.ParseBool(os.Getenv("ZFS_OK"))
+}
+
+func (monitor *ZfsMonitor) ComputeZfsStatus() (status ZfsStatus) {
+	status.Pools = make([]ZfsPoolStatus, 0)
+	if monitor.checkZpool {
+		status.Pools = monitor.readPools()
+	}
+	status.Arc = monitor.readArc()
+	return
+}
+
+func (monitor *ZfsMonitor) readPools() []ZfsPoolStatus {
+	statusOutput, err := exec.Command("zpool", "status", "-p").Output()
+	if err != nil {
+		slog.Error("ZFS error running command 'zpool status -p'", slog.String("error", err.Error()))
+		return make([]ZfsPoolStatus, 0)
+	}
+	pools := parseZpoolStatus(statusOutput)
+
+	listOutput, err := exec.Command("zpool", "list", "-Hp", "-o", "name,size,alloc,free,frag,health").Output()
+	if err != nil {
+		slog.Error("ZFS error running command 'zpool list -Hp'", slog.String("error", err.Error()))
+		return pools
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(listOutput))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 6 {
+			slog.Warn("ZFS unable to parse zpool list", "line", scanner.Text())
+			continue
+		}
+		for i := range pools {
+			if pools[i].Name != fields[0] {
+				continue
+			}
+			toUnit := monitor.bytesToCorrectUnit.Get(fields[0])
+			size, _ := strconv.ParseFloat(fields[1], 64)
+			allocated, _ := strconv.ParseFloat(fields[2], 64)
+			free, _ := strconv.ParseFloat(fields[3], 64)
+			pools[i].Total = toUnit(size)
+			pools[i].Used = toUnit(allocated)
+			pools[i].Free = toUnit(free)
+			if size > 0 {
+				pools[i].UsedPercent = allocated / size * 100
+			}
+			// fragmentation is "-" when unknown
+			pools[i].FragmentationPercent, _ = strconv.ParseFloat(fields[4], 64)
+			pools[i].Health = fields[5]
+		}
+	}
+
+	slog.Debug("ZFS pools read", "pools", pools)
+	return pools
+}
+
+var zfsPercentDoneRegex = regexp.MustCompile(`([\d.]+)% done`)
+var zfsToGoRegex = regexp.MustCompile(`(?:(\d+) days )?(\d+):(\d+):(\d+) to go`)
+var zfsScanErrorsRegex = regexp.MustCompile(`with (\d+) errors`)
+
+// parseZpoolStatus parses the output of zpool status -p, which describes every pool with "key: value" sections
+func parseZpoolStatus(content []byte) []ZfsPoolStatus {
+	pools := make([]ZfsPoolStatus, 0)
+	var pool *ZfsPoolStatus
+	section := ""
+	scanLines := make([]string, 0)
+
+	finishPool := func() {
+		if pool == nil {
+			return
+		}
+		pool.Scan = parseZfsScan(scanLines)
+		pools = append(pools, *pool)
+		scanLines = scanLines[:0]
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if key, value, found := strings.Cut(trimmed, ":"); found && !strings.HasPrefix(line, "\t") && !strings.Contains(key, " ") {
+			section = key
+			value = strings.TrimSpace(value)
+			switch section {
+			case "pool":
+				finishPool()
+				pool = &ZfsPoolStatus{Name: value, Vdevs: make([]ZfsVdevStatus, 0)}
+			case "state":
+				if pool != nil {
+					pool.Health = value
+				}
+			case "scan":
+				scanLines = append(scanLines, value)
+			case "errors":
+				if pool != nil {
+					pool.Errors = value
+				}
+			}
+			continue
+		}
+
+		if pool == nil || trimmed == "" {
+			continue
+		}
+
+		switch section {
+		case "scan":
+			scanLines = append(scanLines, trimmed)
+		case "config":
+			fields := strings.Fields(trimmed)
+			if fields[0] == "NAME" || len(fields) < 2 {
+				continue
+			}
+			indent := strings.TrimPrefix(line, "\t")
+			vdev := ZfsVdevStatus{
+				Name:  fields[0],
+				State: fields[1],
+				Depth: (len(indent) - len(strings.TrimLeft(indent, " "))) / 2,
+			}
+			if len(fields) >= 5 {
+				vdev.ReadErrors, _ = strconv.ParseUint(fields[2], 10, 64)
+				vdev.WriteErrors, _ = strconv.ParseUint(fields[3], 10, 64)
+				vdev.ChecksumErrors, _ = strconv.ParseUint(fields[4], 10, 64)
+			}
+			pool.Vdevs = append(pool.Vdevs, vdev)
+		}
+	}
+	finishPool()
+
+	return pools
+}
+
+// parseZfsScan parses the scan section, e.g. "scrub repaired 0B in 00:10:12 with 0 errors on Sun Jan 14 00:34:13 2024",
+// or "scrub in progress since ..." followed by lines such as "0B repaired, 26.67% done, 02:00:00 to go".
+func parseZfsScan(lines []string) (scan ZfsScanStatus) {
+	scan.State = ZfsScanNone
+	if len(lines) == 0 {
+		return
+	}
+	description := strings.Join(lines, " ")
+	scan.Description = description
+
+	switch {
+	case strings.HasPrefix(description, "scrub"):
+		scan.Function = ZfsScanScrub
+	case strings.HasPrefix(description, "resilver"):
+		scan.Function = ZfsScanResilver
+	default:
+		return
+	}
+
+	switch {
+	case strings.Contains(description, "in progress"):
+		scan.State = ZfsScanInProgress
+	case strings.Contains(description, "paused"):
+		scan.State = ZfsScanPaused
+	case strings.Contains(description, "canceled"):
+		scan.State = ZfsScanCanceled
+	default:
+		scan.State = ZfsScanFinished
+		scan.Percent = 100
+	}
+
+	if res := zfsPercentDoneRegex.FindStringSubmatch(description); len(res) > 1 {
+		scan.Percent, _ = strconv.ParseFloat(res[1], 64)
+	}
+	if res := zfsToGoRegex.FindStringSubmatch(description); len(res) > 4 {
+		days, _ := strconv.ParseUint(res[1], 10, 64)
+		hours, _ := strconv.ParseUint(res[2], 10, 64)
+		minutes, _ := strconv.ParseUint(res[3], 10, 64)
+		seconds, _ := strconv.ParseUint(res[4], 10, 64)
+		scan.EtaSeconds = ((days*24+hours)*60+minutes)*60 + seconds
+	}
+	if res := zfsScanErrorsRegex.FindStringSubmatch(description); len(res) > 1 {
+		scan.Errors, _ = strconv.ParseUint(res[1], 10, 64)
+	}
+	return
+}
+
+func (monitor *ZfsMonitor) readArc() *ZfsArcStatus {
+	path := hostPath("/proc/spl/kstat/zfs/arcstats")
+	content, err := os.ReadFile(path)
+	if err != nil {
+		slog.Debug("ZFS unable to read arcstats", "path", path, "error", err.Error())
+		return nil
+	}
+
+	stats := parseArcstats(content)
+	arc := ZfsArcStatus{
+		Size:       monitor.bytesToMemoryUnit(float64(stats["size"])),
+		TargetSize: monitor.bytesToMemoryUnit(float64(stats["c"])),
+		MaxSize:    monitor.bytesToMemoryUnit(float64(stats["c_max"])),
+		Hits:       stats["hits"],
+		Misses:     stats["misses"],
+	}
+	if arc.Hits+arc.Misses > 0 {
+		arc.HitRatioPercent = float64(arc.Hits) / float64(arc.Hits+arc.Misses) * 100
+	}
+	return &arc
+}
+
+// parseArcstats parses the "name type data" table of arcstats
+func parseArcstats(content []byte) map[string]uint64 {
+	stats := make(map[string]uint64)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		stats[fields[0]] = value
+	}
+	return stats
+}
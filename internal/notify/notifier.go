@@ -0,0 +1,194 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+)
+
+// alerts waiting to be delivered by a sink, further ones are dropped
+const queueSize = 100
+
+// a single attempt at delivering is given up after this long
+const sendTimeout = 30 * time.Second
+
+// Message is what a sink delivers, Title and Body being the text form of the alert
+type Message struct {
+	Title string
+	Body  string
+	Alert report.Alert
+}
+
+func newMessage(alert report.Alert) Message {
+	title := fmt.Sprintf("[%s] %s", strings.ToUpper(alert.State), alert.Name)
+	body := fmt.Sprintf("%s is %v (%s)", alert.Path, alert.Value, alert.Expr)
+	if alert.State == report.AlertResolved {
+		body = fmt.Sprintf("%s is back to %v (%s)", alert.Path, alert.Value, alert.Expr)
+	}
+	return Message{Title: title, Body: body, Alert: alert}
+}
+
+type sink interface {
+	send(ctx context.Context, message Message) error
+}
+
+func newSink(notifier conf.Notifier) (sink, error) {
+	switch notifier.Type {
+	case "webhook":
+		return newWebhookSink(notifier)
+	case "ntfy":
+		return ntfySink{url: notifier.Url, token: notifier.Token}, nil
+	case "gotify":
+		return gotifySink{url: notifier.Url, token: notifier.Token}, nil
+	case "discord":
+		return chatSink{url: notifier.Url, field: "content", bold: "**"}, nil
+	case "slack":
+		return chatSink{url: notifier.Url, field: "text", bold: "*"}, nil
+	case "smtp":
+		if notifier.Smtp == nil {
+			return nil, fmt.Errorf("smtp section is missing")
+		}
+		return smtpSink{conf: *notifier.Smtp}, nil
+	case "unraid":
+		return newUnraidSink(notifier), nil
+	}
+	return nil, fmt.Errorf("unknown type %s, expected webhook, ntfy, gotify, discord, slack, smtp or unraid", notifier.Type)
+}
+
+// dispatcher delivers the alerts to a sink in the background, retrying with an exponential backoff.
+// The same alert in the same state is only delivered once per dedup period, and at most rateLimit alerts per ratePeriod.
+type dispatcher struct {
+	name       string
+	sink       sink
+	severities map[string]bool
+	retries    int
+	backoff    time.Duration
+	rateLimit  int
+	ratePeriod time.Duration
+	dedup      time.Duration
+	queue      chan report.Alert
+
+	mu sync.Mutex
+	// name, path and state -> last delivery
+	delivered map[string]time.Time
+	// deliveries within the rate period
+	recent []time.Time
+}
+
+// accept applies the severities, deduplication and rate limit, recording the delivery if accepted
+func (d *dispatcher) accept(alert report.Alert, now time.Time) bool {
+	if len(d.severities) > 0 && !d.severities[alert.Severity] {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := alert.Name + "|" + alert.Path + "|" + alert.State
+	if last, exists := d.delivered[key]; exists && now.Sub(last) < d.dedup {
+		slog.Debug("Notify skipping duplicate", "notifier", d.name, "alert", alert.Name, "path", alert.Path)
+		return false
+	}
+
+	first := 0
+	for first < len(d.recent) && now.Sub(d.recent[first]) >= d.ratePeriod {
+		first++
+	}
+	d.recent = d.recent[first:]
+	if len(d.recent) >= d.rateLimit {
+		slog.Warn("Notify rate limit reached, dropping alert", "notifier", d.name, "alert", alert.Name, "path", alert.Path)
+		return false
+	}
+
+	for key, last := range d.delivered {
+		if now.Sub(last) >= d.dedup {
+			delete(d.delivered, key)
+		}
+	}
+	d.delivered[key] = now
+	d.recent = append(d.recent, now)
+	return true
+}
+
+func (d *dispatcher) run() {
+	for alert := range d.queue {
+		d.deliver(newMessage(alert))
+	}
+}
+
+func (d *dispatcher) deliver(message Message) {
+	backoff := d.backoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		err := d.sink.send(ctx, message)
+		cancel()
+		if err == nil {
+			slog.Info("Notify sent", "notifier", d.name, "title", message.Title)
+			return
+		}
+		if attempt >= d.retries {
+			slog.Error("Notify unable to send, giving up", slog.String("notifier", d.name), slog.String("title", message.Title), slog.String("error", err.Error()))
+			return
+		}
+		slog.Warn("Notify unable to send, retrying", "notifier", d.name, "in", backoff, "error", err.Error())
+		time.Sleep(backoff)
+		backoff = backoff * 2
+	}
+}
+
+// Notifier hands the alerts over to every configured sink, it implements report.AlertNotifier.
+type Notifier struct {
+	dispatchers []*dispatcher
+}
+
+func NewNotifier(notifiers []conf.Notifier) *Notifier {
+	notifier := &Notifier{}
+	for _, configuration := range notifiers {
+		sink, err := newSink(configuration)
+		if err != nil {
+			slog.Error("Notifier ignored", slog.String("name", configuration.Name), slog.String("error", err.Error()))
+			continue
+		}
+
+		severities := make(map[string]bool, len(configuration.Severities))
+		for _, severity := range configuration.Severities {
+			severities[severity] = true
+		}
+		d := &dispatcher{
+			name:       configuration.Name,
+			sink:       sink,
+			severities: severities,
+			retries:    *configuration.Retries,
+			backoff:    configuration.Backoff,
+			rateLimit:  configuration.RateLimit,
+			ratePeriod: configuration.RatePeriod,
+			dedup:      configuration.Dedup,
+			queue:      make(chan report.Alert, queueSize),
+			delivered:  make(map[string]time.Time),
+		}
+		go d.run()
+		notifier.dispatchers = append(notifier.dispatchers, d)
+		slog.Info("Notifier", "name", configuration.Name, "type", configuration.Type)
+	}
+	return notifier
+}
+
+func (notifier *Notifier) Notify(alert report.Alert) {
+	now := time.Now()
+	for _, d := range notifier.dispatchers {
+		if !d.accept(alert, now) {
+			continue
+		}
+		select {
+		case d.queue <- alert:
+		default:
+			slog.Warn("Notify queue full, dropping alert", "notifier", d.name, "alert", alert.Name)
+		}
+	}
+}
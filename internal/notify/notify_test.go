@@ -0,0 +1,262 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+)
+
+var testAlert = report.Alert{
+	Name:     "disk_hot",
+	Severity: "critical",
+	Expr:     "disk.temp > 50",
+	Path:     "array.disk1.temp",
+	State:    report.AlertFiring,
+	Value:    55.0,
+}
+
+func TestHttpSinks(t *testing.T) {
+	type received struct {
+		path    string
+		headers http.Header
+		body    string
+	}
+	requests := make(chan received, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{path: r.URL.Path, headers: r.Header, body: string(body)}
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		notifier conf.Notifier
+		path     string
+		header   string
+		value    string
+		body     string
+	}{
+		{
+			notifier: conf.Notifier{Type: "webhook", Url: server.URL + "/hook", Headers: map[string]string{"X-Key": "secret"},
+				Template: `{"text": {{json .Title}}, "path": "{{.Alert.Path}}"}`},
+			path: "/hook", header: "X-Key", value: "secret",
+			body: `{"text": "[FIRING] disk_hot", "path": "array.disk1.temp"}`,
+		},
+		{
+			notifier: conf.Notifier{Type: "ntfy", Url: server.URL + "/alerts", Token: "tk"},
+			path:     "/alerts", header: "Priority", value: "urgent",
+			body: "array.disk1.temp is 55 (disk.temp > 50)",
+		},
+		{
+			notifier: conf.Notifier{Type: "gotify", Url: server.URL + "/", Token: "app"},
+			path:     "/message", header: "X-Gotify-Key", value: "app",
+			body: `{"message":"array.disk1.temp is 55 (disk.temp > 50)","priority":8,"title":"[FIRING] disk_hot"}`,
+		},
+		{
+			notifier: conf.Notifier{Type: "discord", Url: server.URL + "/discord"},
+			path:     "/discord", header: "Content-Type", value: "application/json",
+			body: `{"content":"**[FIRING] disk_hot**\narray.disk1.temp is 55 (disk.temp > 50)"}`,
+		},
+	}
+
+	for _, c := range cases {
+		sink, err := newSink(c.notifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.send(context.Background(), newMessage(testAlert)); err != nil {
+			t.Fatalf("%s: %v", c.notifier.Type, err)
+		}
+		request := <-requests
+		if request.path != c.path || request.headers.Get(c.header) != c.value || request.body != c.body {
+			t.Errorf("%s: expected %s %s=%s %s, got %s %s=%s %s", c.notifier.Type,
+				c.path, c.header, c.value, c.body, request.path, c.header, request.headers.Get(c.header), request.body)
+		}
+	}
+}
+
+// serveSmtp answers a single session with the bare minimum of the protocol, returning the data sent
+func serveSmtp(t *testing.T, listener net.Listener) <-chan string {
+	data := make(chan string, 1)
+	go func() {
+		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		reader := bufio.NewReader(connection)
+		reply := func(line string) { connection.Write([]byte(line + "\r\n")) }
+
+		reply("220 localhost")
+		var received strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(command, "EHLO"):
+				reply("250 localhost")
+			case strings.HasPrefix(command, "DATA"):
+				reply("354 go ahead")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					received.WriteString(line)
+				}
+				reply("250 ok")
+			case strings.HasPrefix(command, "QUIT"):
+				reply("221 bye")
+				data <- received.String()
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return data
+}
+
+func TestSmtpSink(t *testing.T) {
+	cases := []struct {
+		name    string
+		alert   string
+		subject string
+	}{
+		{"plain", "disk_hot", "Subject: [FIRING] disk_hot\r\n"},
+		{"encoded", "disque_température\r\nBcc: eve@home", "Subject: =?utf-8?q?[FIRING]_disque=5Ftemp=C3=A9rature_Bcc:_eve@home?=\r\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			data := serveSmtp(t, listener)
+
+			port := listener.Addr().(*net.TCPAddr).Port
+			sink, _ := newSink(conf.Notifier{Type: "smtp", Smtp: &conf.Smtp{Host: "127.0.0.1", Port: port, From: "unraid@home", To: []string{"me@home"}}})
+			alert := testAlert
+			alert.Name = c.alert
+			if err := sink.send(context.Background(), newMessage(alert)); err != nil {
+				t.Fatal(err)
+			}
+
+			email := <-data
+			for _, expected := range []string{"To: me@home\r\n", c.subject, "\r\narray.disk1.temp is 55 (disk.temp > 50)\r\n"} {
+				if !strings.Contains(email, expected) {
+					t.Errorf("expected the email to contain %q, got:\n%s", expected, email)
+				}
+			}
+			if strings.Contains(email, "\r\nBcc:") {
+				t.Errorf("expected no header to be injected, got:\n%s", email)
+			}
+		})
+	}
+}
+
+func TestUnraidSink(t *testing.T) {
+	command := "/usr/local/emhttp/webGui/scripts/notify"
+	host := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(host, filepath.Dir(command)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(host, command), []byte("#!/usr/bin/php\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		prefix string
+		args   []string
+	}{
+		{"on the host", "", []string{command}},
+		{"in the container", host, []string{"chroot", host, command}},
+		{"not mounted", t.TempDir(), []string{command}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("HOSTFS_PREFIX", c.prefix)
+			sink, err := newSink(conf.Notifier{Type: "unraid", Command: command})
+			if err != nil {
+				t.Fatal(err)
+			}
+			args := sink.(unraidSink).cmd(context.Background(), newMessage(testAlert)).Args
+			expected := append(c.args, "-e", unraidNotifyEvent, "-s", "[FIRING] disk_hot", "-d", "array.disk1.temp is 55 (disk.temp > 50)", "-i", "alert")
+			if !slices.Equal(args, expected) {
+				t.Fatalf("expected %q, got %q", expected, args)
+			}
+		})
+	}
+}
+
+type failingSink struct {
+	failures int
+	sent     chan Message
+}
+
+func (sink *failingSink) send(ctx context.Context, message Message) error {
+	if sink.failures > 0 {
+		sink.failures--
+		return errors.New("unavailable")
+	}
+	sink.sent <- message
+	return nil
+}
+
+func TestDispatcher(t *testing.T) {
+	sink := &failingSink{failures: 2, sent: make(chan Message, 10)}
+	d := &dispatcher{
+		name:       "test",
+		sink:       sink,
+		severities: map[string]bool{"critical": true},
+		retries:    2,
+		backoff:    time.Millisecond,
+		rateLimit:  2,
+		ratePeriod: time.Hour,
+		dedup:      time.Minute,
+		delivered:  make(map[string]time.Time),
+	}
+
+	// retried until it succeeds
+	d.deliver(newMessage(testAlert))
+	if len(sink.sent) != 1 {
+		t.Fatalf("expected the message to be sent after the retries")
+	}
+
+	now := time.Unix(1700000000, 0)
+	other := testAlert
+	other.Path = "array.disk2.temp"
+	info := testAlert
+	info.Severity = "info"
+	accepted := []bool{
+		d.accept(testAlert, now),
+		d.accept(testAlert, now.Add(time.Second)),   // duplicate
+		d.accept(info, now.Add(time.Second)),        // filtered severity
+		d.accept(other, now.Add(2*time.Minute)),     // second one within the rate period
+		d.accept(testAlert, now.Add(3*time.Minute)), // rate limited
+		d.accept(testAlert, now.Add(2*time.Hour)),   // rate period elapsed
+	}
+	expected := []bool{true, false, false, true, false, true}
+	for i := range expected {
+		if accepted[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, accepted)
+		}
+	}
+}
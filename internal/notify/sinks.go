@@ -0,0 +1,264 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+)
+
+const unraidNotifyEvent = "Unraid Simple Monitoring API"
+
+var httpClient = &http.Client{}
+
+// line breaks in a header would end it and start another one
+var headerLineBreaks = strings.NewReplacer("\r", "", "\n", " ")
+
+// marshal does not escape HTML characters, the text being shown as is by chat services
+func marshal(value any) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+// post sends the body, any status other than 2xx being an error
+func post(ctx context.Context, url string, contentType string, body []byte, headers map[string]string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		responseBody, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%s responded %s: %s", url, response.Status, strings.TrimSpace(string(responseBody)))
+	}
+	return nil
+}
+
+// priority maps the severity to a scale where critical is high and info is low, resolved alerts being low
+func priority(alert report.Alert, critical string, warning string, low string) string {
+	if alert.State == report.AlertResolved {
+		return low
+	}
+	switch alert.Severity {
+	case "critical":
+		return critical
+	case "warning":
+		return warning
+	}
+	return low
+}
+
+// webhookSink posts the alert as JSON, or the body rendered from the template if any
+type webhookSink struct {
+	url      string
+	headers  map[string]string
+	template *template.Template
+}
+
+func newWebhookSink(notifier conf.Notifier) (sink, error) {
+	sink := webhookSink{url: notifier.Url, headers: notifier.Headers}
+	if notifier.Template != "" {
+		parsed, err := template.New(notifier.Name).Funcs(template.FuncMap{
+			"json": func(value any) (string, error) {
+				marshalled, err := marshal(value)
+				return string(marshalled), err
+			},
+		}).Parse(notifier.Template)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse template: %w", err)
+		}
+		sink.template = parsed
+	}
+	return sink, nil
+}
+
+func (sink webhookSink) send(ctx context.Context, message Message) error {
+	var body []byte
+	if sink.template != nil {
+		var buffer bytes.Buffer
+		if err := sink.template.Execute(&buffer, message); err != nil {
+			return err
+		}
+		body = buffer.Bytes()
+	} else {
+		marshalled, err := marshal(map[string]any{"title": message.Title, "body": message.Body, "alert": message.Alert})
+		if err != nil {
+			return err
+		}
+		body = marshalled
+	}
+	return post(ctx, sink.url, "application/json", body, sink.headers)
+}
+
+// ntfySink publishes to a topic, the url being e.g. https://ntfy.sh/mytopic
+type ntfySink struct {
+	url   string
+	token string
+}
+
+func (sink ntfySink) send(ctx context.Context, message Message) error {
+	headers := map[string]string{
+		"Title":    message.Title,
+		"Priority": priority(message.Alert, "urgent", "high", "default"),
+		"Tags":     message.Alert.Severity + "," + message.Alert.State,
+	}
+	if sink.token != "" {
+		headers["Authorization"] = "Bearer " + sink.token
+	}
+	return post(ctx, sink.url, "text/plain", []byte(message.Body), headers)
+}
+
+// gotifySink posts a message to the server at url, token being the application's token
+type gotifySink struct {
+	url   string
+	token string
+}
+
+func (sink gotifySink) send(ctx context.Context, message Message) error {
+	gotifyPriority, _ := strconv.Atoi(priority(message.Alert, "8", "5", "2"))
+	body, err := marshal(map[string]any{"title": message.Title, "message": message.Body, "priority": gotifyPriority})
+	if err != nil {
+		return err
+	}
+	return post(ctx, strings.TrimRight(sink.url, "/")+"/message", "application/json", body, map[string]string{"X-Gotify-Key": sink.token})
+}
+
+// chatSink posts to a Discord or Slack compatible webhook, which only differ by the field holding the text
+type chatSink struct {
+	url   string
+	field string
+	bold  string
+}
+
+func (sink chatSink) send(ctx context.Context, message Message) error {
+	body, err := marshal(map[string]string{sink.field: sink.bold + message.Title + sink.bold + "\n" + message.Body})
+	if err != nil {
+		return err
+	}
+	return post(ctx, sink.url, "application/json", body, nil)
+}
+
+// smtpSink sends an email, upgrading the connection with STARTTLS when the server supports it
+type smtpSink struct {
+	conf conf.Smtp
+}
+
+func (sink smtpSink) send(ctx context.Context, message Message) error {
+	address := net.JoinHostPort(sink.conf.Host, strconv.Itoa(sink.conf.Port))
+	connection, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		connection.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(connection, sink.conf.Host)
+	if err != nil {
+		connection.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: sink.conf.Host}); err != nil {
+			return err
+		}
+	}
+	if sink.conf.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", sink.conf.Username, sink.conf.Password, sink.conf.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(sink.conf.From); err != nil {
+		return err
+	}
+	for _, to := range sink.conf.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	subject := mime.QEncoding.Encode("utf-8", headerLineBreaks.Replace(message.Title))
+	fmt.Fprintf(writer, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		sink.conf.From, strings.Join(sink.conf.To, ", "), subject, time.Now().Format(time.RFC1123Z), message.Body)
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// unraidSink runs Unraid's notify script, which shows the alert in the web UI and forwards it to Unraid's own agents
+type unraidSink struct {
+	command string
+	// the host's filesystem, the script is run within it when found there
+	root string
+}
+
+// newUnraidSink finds the script on the host's filesystem mounted at HOSTFS_PREFIX, if any.
+// The script needs the host's PHP and writes the host's notifications, so it is not enough to run it from the mount:
+// it is run with the mount as its root, as if on the host.
+func newUnraidSink(notifier conf.Notifier) unraidSink {
+	sink := unraidSink{command: notifier.Command}
+	if root := os.Getenv("HOSTFS_PREFIX"); root != "" {
+		if _, err := os.Stat(filepath.Join(root, notifier.Command)); err == nil {
+			sink.root = root
+		}
+	}
+	return sink
+}
+
+func (sink unraidSink) cmd(ctx context.Context, message Message) *exec.Cmd {
+	args := []string{
+		"-e", unraidNotifyEvent,
+		"-s", message.Title,
+		"-d", message.Body,
+		"-i", priority(message.Alert, "alert", "warning", "normal"),
+	}
+	if sink.root != "" {
+		return exec.CommandContext(ctx, "chroot", append([]string{sink.root, sink.command}, args...)...)
+	}
+	return exec.CommandContext(ctx, sink.command, args...)
+}
+
+func (sink unraidSink) send(ctx context.Context, message Message) error {
+	output, err := sink.cmd(ctx, message).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package publish
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+)
+
+// connecting and sending are given up on after this long
+const graphiteTimeout = 10 * time.Second
+
+// StatsD lines are grouped in datagrams no larger than this, staying below the usual MTU
+const statsdMaxPacketSize = 1432
+
+// anything else would be taken as a path separator or break the line, e.g. /mnt/disk1 becomes mnt_disk1
+var graphiteSegmentReplacer = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// GraphiteExporter sends every value under its path in the report, e.g. unraid.tower.array.disk1.used_percent,
+// either over the Graphite plaintext protocol or as StatsD gauges
+type GraphiteExporter struct {
+	conf   conf.Graphite
+	units  conf.Units
+	filter report.Filter
+	statsd bool
+}
+
+func NewGraphiteExporter(configuration conf.Graphite, units conf.Units, filter report.Filter) *GraphiteExporter {
+	return &GraphiteExporter{conf: configuration, units: units, filter: filter}
+}
+
+func NewStatsdExporter(configuration conf.Graphite, units conf.Units, filter report.Filter) *GraphiteExporter {
+	return &GraphiteExporter{conf: configuration, units: units, filter: filter, statsd: true}
+}
+
+func (exporter *GraphiteExporter) protocol() string {
+	if exporter.statsd {
+		return "StatsD"
+	}
+	return "Graphite"
+}
+
+// Run sends the latest sample on every interval, until the context is cancelled
+func (exporter *GraphiteExporter) Run(ctx context.Context, sampler *report.Sampler) {
+	slog.Info(exporter.protocol()+" exporting", "address", exporter.conf.Address, "prefix", exporter.conf.Prefix, "interval", exporter.conf.Interval)
+	every(ctx, exporter.conf.Interval, sampler, exporter.export)
+}
+
+func (exporter *GraphiteExporter) export(sample report.Report) {
+	flattened := points(sample, exporter.units, exporter.filter)
+	var err error
+	var lines []string
+	if exporter.statsd {
+		lines = statsdLines(flattened, exporter.conf.Prefix)
+		err = exporter.sendStatsd(lines)
+	} else {
+		lines = graphiteLines(flattened, exporter.conf.Prefix, sample.SampledAt)
+		err = exporter.sendGraphite(lines)
+	}
+	if err != nil {
+		slog.Warn(exporter.protocol()+" unable to send", slog.String("address", exporter.conf.Address), slog.String("error", err.Error()))
+		return
+	}
+	slog.Debug(exporter.protocol()+" sent", "lines", len(lines))
+}
+
+// sendGraphite opens a connection for every sample, Carbon closing idle ones anyway
+func (exporter *GraphiteExporter) sendGraphite(lines []string) error {
+	connection, err := net.DialTimeout("tcp", exporter.conf.Address, graphiteTimeout)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	connection.SetWriteDeadline(time.Now().Add(graphiteTimeout))
+	_, err = connection.Write([]byte(strings.Join(lines, "")))
+	return err
+}
+
+func (exporter *GraphiteExporter) sendStatsd(lines []string) error {
+	connection, err := net.DialTimeout("udp", exporter.conf.Address, graphiteTimeout)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	for _, packet := range statsdPackets(lines) {
+		if _, err := connection.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metricPath joins the prefix and the sanitised path elements with dots
+func metricPath(prefix string, path []string) string {
+	segments := make([]string, 0, len(path)+1)
+	if prefix = strings.Trim(prefix, "."); prefix != "" {
+		segments = append(segments, prefix)
+	}
+	for _, element := range path {
+		segment := strings.Trim(graphiteSegmentReplacer.ReplaceAllString(element, "_"), "_")
+		if segment == "" {
+			segment = "_"
+		}
+		segments = append(segments, segment)
+	}
+	return strings.Join(segments, ".")
+}
+
+// graphiteLines formats a "<path> <value> <timestamp>\n" line per value
+func graphiteLines(flattened []point, prefix string, at time.Time) []string {
+	lines := make([]string, 0, len(flattened))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	for _, p := range flattened {
+		if math.IsNaN(p.sample.Value) || math.IsInf(p.sample.Value, 0) {
+			continue
+		}
+		lines = append(lines, metricPath(prefix, p.sample.Path)+" "+strconv.FormatFloat(p.sample.Value, 'f', -1, 64)+" "+timestamp+"\n")
+	}
+	return lines
+}
+
+// statsdLines formats a gauge per value. A signed gauge value is taken as a change to the current one,
+// negative values are therefore set by going through 0 first, within the same line so they are never split.
+func statsdLines(flattened []point, prefix string) []string {
+	lines := make([]string, 0, len(flattened))
+	for _, p := range flattened {
+		if math.IsNaN(p.sample.Value) || math.IsInf(p.sample.Value, 0) {
+			continue
+		}
+		name := metricPath(prefix, p.sample.Path)
+		line := name + ":" + strconv.FormatFloat(p.sample.Value, 'f', -1, 64) + "|g\n"
+		if p.sample.Value < 0 {
+			line = name + ":0|g\n" + line
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// statsdPackets groups the lines in as few datagrams as possible, a line never being split
+func statsdPackets(lines []string) [][]byte {
+	var packets [][]byte
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+len(line) > statsdMaxPacketSize {
+			packets = append(packets, packet)
+			packet = nil
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		packets = append(packets, packet)
+	}
+	return packets
+}
@@ -0,0 +1,77 @@
+package publish
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+)
+
+func TestMetricPath(t *testing.T) {
+	cases := []struct {
+		prefix   string
+		path     []string
+		expected string
+	}{
+		{"unraid.tower", []string{"array", "disk1", "used_percent"}, "unraid.tower.array.disk1.used_percent"},
+		{"unraid.", []string{"array", "/mnt/disk1", "temp"}, "unraid.array.mnt_disk1.temp"},
+		{"", []string{"shares", "media files.2024", ""}, "shares.media_files_2024._"},
+	}
+	for _, c := range cases {
+		if path := metricPath(c.prefix, c.path); path != c.expected {
+			t.Errorf("expected %s, got %s", c.expected, path)
+		}
+	}
+}
+
+func TestStatsdLines(t *testing.T) {
+	flattened := []point{
+		{sample: report.Sample{Path: []string{"array", "disk1", "temp"}, Value: 34}},
+		{sample: report.Sample{Path: []string{"array", "total", "forecast", "fill_rate"}, Value: -1.5}},
+	}
+	lines := statsdLines(flattened, "unraid")
+	expected := "unraid.array.disk1.temp:34|g\nunraid.array.total.forecast.fill_rate:0|g\nunraid.array.total.forecast.fill_rate:-1.5|g\n"
+	if strings.Join(lines, "") != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, strings.Join(lines, ""))
+	}
+
+	long := strings.Repeat("a", 1000) + ":1|g\n"
+	if packets := statsdPackets([]string{long, long, "b:1|g\n"}); len(packets) != 2 || string(packets[1]) != long+"b:1|g\n" {
+		t.Fatalf("expected the lines to be split in 2 packets, got %d", len(packets))
+	}
+}
+
+func TestGraphiteSend(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []string, 1)
+	go func() {
+		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer connection.Close()
+		var lines []string
+		scanner := bufio.NewScanner(connection)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+
+	exporter := NewGraphiteExporter(conf.Graphite{Address: listener.Addr().String(), Prefix: "unraid.tower"}, conf.Units{}, report.Filter{})
+	flattened := []point{{sample: report.Sample{Path: []string{"cpu", "load_percent"}, Value: 12.5}}}
+	if err := exporter.sendGraphite(graphiteLines(flattened, "unraid.tower", time.Unix(1700000000, 0))); err != nil {
+		t.Fatal(err)
+	}
+	if lines := <-received; len(lines) != 1 || lines[0] != "unraid.tower.cpu.load_percent 12.5 1700000000" {
+		t.Fatalf("unexpected lines %q", lines)
+	}
+}
@@ -0,0 +1,237 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+)
+
+// a single write is given up on after this long
+const influxWriteTimeout = 30 * time.Second
+
+var influxMeasurementReplacer = strings.NewReplacer(",", `\,`, " ", `\ `)
+var influxTagReplacer = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// errInfluxRejected is returned when InfluxDB refuses the points themselves, writing them again would not help
+var errInfluxRejected = errors.New("points rejected")
+
+// InfluxExporter writes every metric in line protocol, one measurement per metric with the value in the "value" field, e.g.
+// unraid_disk_temp_celsius,disk_id=WDC_WD40,mount=/mnt/disk1,pool=array value=34 1700000000
+type InfluxExporter struct {
+	conf     conf.Influx
+	units    conf.Units
+	filter   report.Filter
+	writeUrl string
+	client   *http.Client
+}
+
+func NewInfluxExporter(configuration conf.Influx, units conf.Units, filter report.Filter) *InfluxExporter {
+	query := url.Values{"precision": {"s"}}
+	endpoint := "/write"
+	if configuration.Bucket != "" {
+		endpoint = "/api/v2/write"
+		query.Set("org", configuration.Org)
+		query.Set("bucket", configuration.Bucket)
+	} else {
+		query.Set("db", configuration.Database)
+		if configuration.RetentionPolicy != "" {
+			query.Set("rp", configuration.RetentionPolicy)
+		}
+	}
+
+	return &InfluxExporter{
+		conf:     configuration,
+		units:    units,
+		filter:   filter,
+		writeUrl: strings.TrimRight(configuration.Url, "/") + endpoint + "?" + query.Encode(),
+		client:   &http.Client{},
+	}
+}
+
+// Run writes the latest sample on every interval, until the context is cancelled
+func (exporter *InfluxExporter) Run(ctx context.Context, sampler *report.Sampler) {
+	slog.Info("Influx exporting", "url", exporter.conf.Url, "interval", exporter.conf.Interval)
+	every(ctx, exporter.conf.Interval, sampler, exporter.export)
+}
+
+// export writes the points buffered on disk first, then the new ones, buffering whatever could not be written
+func (exporter *InfluxExporter) export(sample report.Report) {
+	buffered, err := exporter.loadBuffer()
+	if err != nil {
+		slog.Error("Influx unable to read buffer", slog.String("path", exporter.conf.BufferPath), slog.String("error", err.Error()))
+	}
+	lines := append(buffered, lineProtocol(points(sample, exporter.units, exporter.filter), exporter.conf.Tags, sample.SampledAt)...)
+
+	written, err := exporter.write(lines)
+	if err != nil {
+		slog.Warn("Influx unable to write, buffering", "url", exporter.conf.Url, "lines", len(lines)-written, "error", err.Error())
+		exporter.saveBuffer(lines[written:])
+		return
+	}
+	if len(buffered) > 0 {
+		slog.Info("Influx buffered points written", "lines", len(buffered))
+		exporter.saveBuffer(nil)
+	}
+	slog.Debug("Influx written", "lines", written)
+}
+
+// write sends the lines in batches, returning how many of them have been dealt with
+func (exporter *InfluxExporter) write(lines []string) (int, error) {
+	for start := 0; start < len(lines); start += exporter.conf.BatchSize {
+		end := min(start+exporter.conf.BatchSize, len(lines))
+		err := exporter.writeBatch(lines[start:end])
+		if errors.Is(err, errInfluxRejected) {
+			slog.Error("Influx dropping batch", slog.String("url", exporter.conf.Url), slog.Int("lines", end-start), slog.String("error", err.Error()))
+			continue
+		}
+		if err != nil {
+			return start, err
+		}
+	}
+	return len(lines), nil
+}
+
+// writeBatch retries with an exponential backoff, unless the points have been rejected
+func (exporter *InfluxExporter) writeBatch(lines []string) error {
+	body := []byte(strings.Join(lines, "\n"))
+	backoff := exporter.conf.Backoff
+	for attempt := 0; ; attempt++ {
+		err := exporter.post(body)
+		if err == nil || errors.Is(err, errInfluxRejected) || attempt >= *exporter.conf.Retries {
+			return err
+		}
+		slog.Debug("Influx unable to write, retrying", "in", backoff, "error", err.Error())
+		time.Sleep(backoff)
+		backoff = backoff * 2
+	}
+}
+
+func (exporter *InfluxExporter) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), influxWriteTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, exporter.writeUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if exporter.conf.Token != "" {
+		request.Header.Set("Authorization", "Token "+exporter.conf.Token)
+	}
+	if exporter.conf.Username != "" {
+		request.SetBasicAuth(exporter.conf.Username, exporter.conf.Password)
+	}
+
+	response, err := exporter.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 200 && response.StatusCode <= 299 {
+		return nil
+	}
+
+	responseBody, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	err = fmt.Errorf("responded %s: %s", response.Status, strings.TrimSpace(string(responseBody)))
+	if response.StatusCode == http.StatusBadRequest || response.StatusCode == http.StatusRequestEntityTooLarge {
+		return fmt.Errorf("%w, %w", errInfluxRejected, err)
+	}
+	return err
+}
+
+func (exporter *InfluxExporter) loadBuffer() ([]string, error) {
+	content, err := os.ReadFile(exporter.conf.BufferPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// saveBuffer replaces the buffer with the lines, the oldest ones being dropped beyond the maximum size.
+// An empty buffer is removed.
+func (exporter *InfluxExporter) saveBuffer(lines []string) {
+	if len(lines) == 0 {
+		if err := os.Remove(exporter.conf.BufferPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Influx unable to remove buffer", slog.String("path", exporter.conf.BufferPath), slog.String("error", err.Error()))
+		}
+		return
+	}
+
+	size := int64(0)
+	first := len(lines)
+	for first > 0 && size+int64(len(lines[first-1])+1) <= exporter.conf.BufferMaxSize {
+		first--
+		size += int64(len(lines[first]) + 1)
+	}
+	if first > 0 {
+		slog.Warn("Influx buffer full, dropping the oldest points", "path", exporter.conf.BufferPath, "lines", first)
+	}
+
+	temporary := exporter.conf.BufferPath + ".tmp"
+	err := os.WriteFile(temporary, []byte(strings.Join(lines[first:], "\n")+"\n"), 0o644)
+	if err == nil {
+		err = os.Rename(temporary, exporter.conf.BufferPath)
+	}
+	if err != nil {
+		slog.Error("Influx unable to write buffer", slog.String("path", exporter.conf.BufferPath), slog.String("error", err.Error()))
+	}
+}
+
+// lineProtocol formats a line per point, the labels becoming tags along with the extra ones,
+// which the labels take precedence over. Labels without a value are left out, InfluxDB rejecting empty tags.
+func lineProtocol(flattened []point, extraTags map[string]string, at time.Time) []string {
+	lines := make([]string, 0, len(flattened))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	for _, p := range flattened {
+		if math.IsNaN(p.sample.Value) || math.IsInf(p.sample.Value, 0) {
+			continue
+		}
+
+		tags := make(map[string]string, len(extraTags)+len(p.sample.Labels))
+		for name, value := range extraTags {
+			tags[name] = value
+		}
+		for _, label := range p.sample.Labels {
+			tags[label.Name] = label.Value
+		}
+		names := make([]string, 0, len(tags))
+		for name, value := range tags {
+			if value != "" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		var line strings.Builder
+		line.WriteString(influxMeasurementReplacer.Replace(p.metric.Name))
+		for _, name := range names {
+			line.WriteString("," + influxTagReplacer.Replace(name) + "=" + influxTagReplacer.Replace(tags[name]))
+		}
+		line.WriteString(" value=" + strconv.FormatFloat(p.sample.Value, 'f', -1, 64) + " " + timestamp)
+		lines = append(lines, line.String())
+	}
+	return lines
+}
@@ -0,0 +1,72 @@
+package publish
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+)
+
+func TestLineProtocol(t *testing.T) {
+	flattened := []point{
+		{metric: report.Metric{Name: "unraid_disk_temp_celsius"}, sample: report.Sample{Value: 34,
+			Labels: []report.Label{{Name: "pool", Value: "array"}, {Name: "mount", Value: "/mnt/disk 1"}, {Name: "disk_id", Value: ""}}}},
+		{metric: report.Metric{Name: "unraid_core_load_percent"}, sample: report.Sample{Value: 12.5,
+			Labels: []report.Label{{Name: "core", Value: "cpu0"}, {Name: "host", Value: "a,b"}}}},
+	}
+	lines := lineProtocol(flattened, map[string]string{"host": "tower"}, time.Unix(1700000000, 0))
+	expected := []string{
+		`unraid_disk_temp_celsius,host=tower,mount=/mnt/disk\ 1,pool=array value=34 1700000000`,
+		`unraid_core_load_percent,core=cpu0,host=a\,b value=12.5 1700000000`,
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+func TestInfluxBuffer(t *testing.T) {
+	var available atomic.Bool
+	received := make(chan string, 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/write" || r.URL.Query().Get("bucket") != "unraid" || r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("unexpected request %s %s", r.URL, r.Header.Get("Authorization"))
+		}
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	retries := 1
+	bufferPath := filepath.Join(t.TempDir(), "buffer.lp")
+	exporter := NewInfluxExporter(conf.Influx{Url: server.URL, Token: "secret", Org: "home", Bucket: "unraid",
+		BatchSize: 2, Retries: &retries, Backoff: time.Millisecond, BufferPath: bufferPath, BufferMaxSize: 1024}, conf.Units{}, report.Filter{})
+
+	if written, err := exporter.write([]string{"a value=1 1", "b value=2 1", "c value=3 1"}); err == nil || written != 0 {
+		t.Fatalf("expected nothing to be written, got %d %v", written, err)
+	}
+	exporter.saveBuffer([]string{"a value=1 1", "b value=2 1", "c value=3 1"})
+
+	available.Store(true)
+	exporter.export(report.Report{SampledAt: time.Unix(1700000000, 0)})
+
+	batches := []string{<-received, <-received}
+	if batches[0] != "a value=1 1\nb value=2 1" || !strings.HasPrefix(batches[1], "c value=3 1\n") {
+		t.Fatalf("expected the buffered points to be written first in batches of 2, got %q", batches)
+	}
+	if _, err := os.Stat(bufferPath); !os.IsNotExist(err) {
+		t.Fatalf("expected the buffer to be removed once written")
+	}
+}
@@ -0,0 +1,303 @@
+package publish
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// a batch of messages is given up on after this long, e.g. when the broker does not acknowledge them
+const mqttPublishTimeout = 10 * time.Second
+
+// alerts come and go, they are left to the notifiers
+const mqttSkippedMetric = "unraid_alert_firing"
+
+// Home Assistant only accepts these characters in node and object ids
+var mqttIdReplacer = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// MQTT wildcards and empty levels would make a topic unusable
+var mqttTopicReplacer = strings.NewReplacer("+", "_", "#", "_", "/", "_")
+
+// metrics reporting a state rather than a quantity, they become binary sensors
+var mqttBinarySensors = map[string]string{
+	"unraid_disk_spinning":             "running",
+	"unraid_parity_spinning":           "running",
+	"unraid_array_started":             "running",
+	"unraid_parity_check_running":      "running",
+	"unraid_zfs_pool_online":           "connectivity",
+	"unraid_pool_btrfs_device_missing": "problem",
+}
+
+// metrics that only ever grow until the array is restarted
+var mqttCounterSuffixes = []string{"_reads", "_writes"}
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	ViaDevice    string   `json:"via_device,omitempty"`
+}
+
+// discoveryConfig is what Home Assistant expects under <discovery prefix>/<component>/<node id>/<object id>/config
+type discoveryConfig struct {
+	Name              string          `json:"name"`
+	UniqueId          string          `json:"unique_id"`
+	ObjectId          string          `json:"object_id"`
+	StateTopic        string          `json:"state_topic"`
+	AvailabilityTopic string          `json:"availability_topic"`
+	DeviceClass       string          `json:"device_class,omitempty"`
+	StateClass        string          `json:"state_class,omitempty"`
+	UnitOfMeasurement string          `json:"unit_of_measurement,omitempty"`
+	PayloadOn         string          `json:"payload_on,omitempty"`
+	PayloadOff        string          `json:"payload_off,omitempty"`
+	Device            discoveryDevice `json:"device"`
+}
+
+// MqttPublisher sends every metric to its own topic, e.g. unraid/array/disk1/temp,
+// and announces them to Home Assistant as sensors grouped by disk, pool and interface.
+type MqttPublisher struct {
+	conf        conf.Mqtt
+	units       conf.Units
+	filter      report.Filter
+	client      mqtt.Client
+	nodeId      string
+	statusTopic string
+
+	mu sync.Mutex
+	// discovery topics already sent since the last connection
+	announced map[string]bool
+}
+
+func NewMqttPublisher(configuration conf.Mqtt, units conf.Units, filter report.Filter) *MqttPublisher {
+	publisher := &MqttPublisher{
+		conf:        configuration,
+		units:       units,
+		filter:      filter,
+		nodeId:      mqttIdReplacer.ReplaceAllString(configuration.ClientId, "_"),
+		statusTopic: configuration.TopicPrefix + "/status",
+		announced:   make(map[string]bool),
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(configuration.Broker).
+		SetClientID(configuration.ClientId).
+		SetUsername(configuration.Username).
+		SetPassword(configuration.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10*time.Second).
+		SetWill(publisher.statusTopic, "offline", configuration.Qos, true).
+		SetOnConnectHandler(publisher.onConnect).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			slog.Warn("Mqtt connection lost", slog.String("broker", configuration.Broker), slog.String("error", err.Error()))
+		})
+	publisher.client = mqtt.NewClient(options)
+	return publisher
+}
+
+// onConnect marks the server as available, and sends the discovery configs again
+// as Home Assistant may have restarted or the broker may have lost its retained messages
+func (publisher *MqttPublisher) onConnect(client mqtt.Client) {
+	slog.Info("Mqtt connected", "broker", publisher.conf.Broker)
+	publisher.forget()
+	client.Publish(publisher.statusTopic, publisher.conf.Qos, true, "online")
+
+	if *publisher.conf.Discovery {
+		// Home Assistant announces itself when it starts, discovery configs are then sent again
+		client.Subscribe(publisher.conf.DiscoveryPrefix+"/status", publisher.conf.Qos, func(client mqtt.Client, message mqtt.Message) {
+			if string(message.Payload()) == "online" {
+				slog.Debug("Mqtt Home Assistant is online, announcing the sensors again")
+				publisher.forget()
+			}
+		})
+	}
+}
+
+func (publisher *MqttPublisher) forget() {
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	publisher.announced = make(map[string]bool)
+}
+
+// Run connects to the broker and publishes the latest sample on every interval, until the context is cancelled
+func (publisher *MqttPublisher) Run(ctx context.Context, sampler *report.Sampler) {
+	slog.Info("Mqtt publishing", "broker", publisher.conf.Broker, "prefix", publisher.conf.TopicPrefix, "interval", publisher.conf.Interval)
+	publisher.client.Connect()
+	every(ctx, publisher.conf.Interval, sampler, publisher.publish)
+
+	publisher.client.Publish(publisher.statusTopic, publisher.conf.Qos, true, "offline").WaitTimeout(mqttPublishTimeout)
+	publisher.client.Disconnect(250)
+}
+
+func (publisher *MqttPublisher) publish(sample report.Report) {
+	if !publisher.client.IsConnectionOpen() {
+		slog.Debug("Mqtt not connected, skipping sample", "broker", publisher.conf.Broker)
+		return
+	}
+
+	publisher.mu.Lock()
+	var tokens []mqtt.Token
+	for _, p := range points(sample, publisher.units, publisher.filter) {
+		if p.metric.Name == mqttSkippedMetric {
+			continue
+		}
+		if *publisher.conf.Discovery {
+			topic, config := discover(publisher.conf, publisher.nodeId, p)
+			if !publisher.announced[topic] {
+				payload, err := json.Marshal(config)
+				if err != nil {
+					slog.Error("Mqtt unable to marshal discovery config", slog.String("topic", topic), slog.String("error", err.Error()))
+					continue
+				}
+				tokens = append(tokens, publisher.client.Publish(topic, publisher.conf.Qos, true, payload))
+				publisher.announced[topic] = true
+			}
+		}
+		tokens = append(tokens, publisher.client.Publish(stateTopic(publisher.conf.TopicPrefix, p.sample.Path), publisher.conf.Qos, publisher.conf.Retain, statePayload(p)))
+	}
+	publisher.mu.Unlock()
+
+	deadline := time.Now().Add(mqttPublishTimeout)
+	for _, token := range tokens {
+		if !token.WaitTimeout(time.Until(deadline)) {
+			slog.Warn("Mqtt publishing timed out", "broker", publisher.conf.Broker)
+			return
+		}
+		if err := token.Error(); err != nil {
+			slog.Warn("Mqtt unable to publish", slog.String("broker", publisher.conf.Broker), slog.String("error", err.Error()))
+			return
+		}
+	}
+	slog.Debug("Mqtt published", "messages", len(tokens))
+}
+
+func stateTopic(prefix string, path []string) string {
+	levels := make([]string, 0, len(path)+1)
+	levels = append(levels, prefix)
+	for _, element := range path {
+		if element == "" {
+			element = "_"
+		}
+		levels = append(levels, mqttTopicReplacer.Replace(element))
+	}
+	return strings.Join(levels, "/")
+}
+
+// statePayload is the value as is, timestamps being formatted as Home Assistant expects them
+func statePayload(p point) string {
+	if strings.HasSuffix(p.metric.Name, "_timestamp_seconds") {
+		return time.Unix(int64(p.sample.Value), 0).UTC().Format(time.RFC3339)
+	}
+	return strconv.FormatFloat(p.sample.Value, 'f', -1, 64)
+}
+
+// deviceOf returns the part of the path identifying the disk, pool, interface or share the value belongs to,
+// nil for the values of the server as a whole such as the cpu and the memory
+func deviceOf(path []string) []string {
+	switch path[0] {
+	case "array", "cache", "parity", "network", "shares":
+		if len(path) > 2 {
+			return path[:2]
+		}
+	case "pools":
+		if len(path) > 4 && path[2] == "disks" {
+			return path[:4]
+		}
+		if len(path) > 2 {
+			return path[:2]
+		}
+	case "zfs":
+		if len(path) > 3 && path[1] == "pools" {
+			return path[:3]
+		}
+	}
+	return nil
+}
+
+// classify maps the unit in the metric name to the Home Assistant device class and unit of measurement
+func classify(name string) (deviceClass string, unit string) {
+	switch {
+	case strings.HasSuffix(name, "_bytes_per_second"):
+		return "data_rate", "B/s"
+	case strings.HasSuffix(name, "_bytes_per_day"):
+		return "", "B/d"
+	case strings.HasSuffix(name, "_bytes"):
+		return "data_size", "B"
+	case strings.HasSuffix(name, "_celsius"):
+		return "temperature", "°C"
+	case strings.HasSuffix(name, "_percent"):
+		return "", "%"
+	case strings.HasSuffix(name, "_timestamp_seconds"):
+		return "timestamp", ""
+	case strings.HasSuffix(name, "_seconds"):
+		return "duration", "s"
+	case strings.HasSuffix(name, "_iops"):
+		return "", "IOPS"
+	}
+	return "", ""
+}
+
+func sensorName(path []string) string {
+	return strings.ReplaceAll(strings.Join(path, " "), "_", " ")
+}
+
+// discover builds the Home Assistant discovery config of the value, returning the topic to send it to
+func discover(configuration conf.Mqtt, nodeId string, p point) (string, discoveryConfig) {
+	path := p.sample.Path
+	objectId := mqttIdReplacer.ReplaceAllString(strings.Join(path, "_"), "_")
+
+	device := discoveryDevice{
+		Identifiers:  []string{nodeId},
+		Name:         configuration.DeviceName,
+		Manufacturer: "Lime Technology",
+		Model:        "Unraid",
+	}
+	name := sensorName(path)
+	if devicePath := deviceOf(path); devicePath != nil {
+		device = discoveryDevice{
+			Identifiers: []string{nodeId + "_" + mqttIdReplacer.ReplaceAllString(strings.Join(devicePath, "_"), "_")},
+			Name:        configuration.DeviceName + " " + strings.Join(devicePath, " "),
+			ViaDevice:   nodeId,
+		}
+		name = sensorName(path[len(devicePath):])
+	}
+
+	config := discoveryConfig{
+		Name:              name,
+		UniqueId:          nodeId + "_" + objectId,
+		ObjectId:          nodeId + "_" + objectId,
+		StateTopic:        stateTopic(configuration.TopicPrefix, path),
+		AvailabilityTopic: configuration.TopicPrefix + "/status",
+		Device:            device,
+	}
+
+	component := "sensor"
+	if deviceClass, isBinary := mqttBinarySensors[p.metric.Name]; isBinary {
+		component = "binary_sensor"
+		config.DeviceClass = deviceClass
+		config.PayloadOn = "1"
+		config.PayloadOff = "0"
+	} else {
+		config.DeviceClass, config.UnitOfMeasurement = classify(p.metric.Name)
+		if config.DeviceClass != "timestamp" {
+			config.StateClass = "measurement"
+			for _, suffix := range mqttCounterSuffixes {
+				if strings.HasSuffix(p.metric.Name, suffix) {
+					config.StateClass = "total_increasing"
+				}
+			}
+		}
+	}
+
+	return strings.Join([]string{configuration.DiscoveryPrefix, component, nodeId, objectId, "config"}, "/"), config
+}
@@ -0,0 +1,61 @@
+package publish
+
+import (
+	"testing"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+)
+
+var testMqtt = conf.Mqtt{TopicPrefix: "unraid", DiscoveryPrefix: "homeassistant", DeviceName: "Tower"}
+
+func TestMqttDiscovery(t *testing.T) {
+	cases := []struct {
+		metric      string
+		path        []string
+		topic       string
+		name        string
+		deviceClass string
+		unit        string
+		device      string
+	}{
+		{"unraid_disk_temp_celsius", []string{"array", "disk1", "temp"},
+			"homeassistant/sensor/node/array_disk1_temp/config", "temp", "temperature", "°C", "node_array_disk1"},
+		{"unraid_disk_used_bytes", []string{"pools", "fast", "disks", "nvme0n1p1", "used"},
+			"homeassistant/sensor/node/pools_fast_disks_nvme0n1p1_used/config", "used", "data_size", "B", "node_pools_fast_disks_nvme0n1p1"},
+		{"unraid_network_receive_bytes_per_second", []string{"network", "eth0", "rx_MiBs"},
+			"homeassistant/sensor/node/network_eth0_rx_MiBs/config", "rx MiBs", "data_rate", "B/s", "node_network_eth0"},
+		{"unraid_core_load_percent", []string{"cores", "cpu0", "load_percent"},
+			"homeassistant/sensor/node/cores_cpu0_load_percent/config", "cores cpu0 load percent", "", "%", "node"},
+		{"unraid_disk_spinning", []string{"array", "disk1", "is_spinning"},
+			"homeassistant/binary_sensor/node/array_disk1_is_spinning/config", "is spinning", "running", "", "node_array_disk1"},
+	}
+
+	for _, c := range cases {
+		topic, config := discover(testMqtt, "node", point{metric: report.Metric{Name: c.metric}, sample: report.Sample{Path: c.path}})
+		if topic != c.topic || config.Name != c.name || config.DeviceClass != c.deviceClass || config.UnitOfMeasurement != c.unit {
+			t.Errorf("%s: expected %s %q %q %q, got %s %q %q %q", c.metric,
+				c.topic, c.name, c.deviceClass, c.unit, topic, config.Name, config.DeviceClass, config.UnitOfMeasurement)
+		}
+		if config.Device.Identifiers[0] != c.device {
+			t.Errorf("%s: expected device %s, got %s", c.metric, c.device, config.Device.Identifiers[0])
+		}
+		if config.StateTopic != stateTopic("unraid", c.path) || config.AvailabilityTopic != "unraid/status" {
+			t.Errorf("%s: unexpected topics %s %s", c.metric, config.StateTopic, config.AvailabilityTopic)
+		}
+	}
+}
+
+func TestMqttState(t *testing.T) {
+	if topic := stateTopic("unraid", []string{"shares", "a/b+c", "free"}); topic != "unraid/shares/a_b_c/free" {
+		t.Errorf("expected the wildcards to be replaced, got %s", topic)
+	}
+
+	timestamp := point{metric: report.Metric{Name: "unraid_disk_estimated_full_timestamp_seconds"}, sample: report.Sample{Value: 1700000000}}
+	if payload := statePayload(timestamp); payload != "2023-11-14T22:13:20Z" {
+		t.Errorf("expected an RFC 3339 timestamp, got %s", payload)
+	}
+	if payload := statePayload(point{metric: report.Metric{Name: "unraid_cpu_load_percent"}, sample: report.Sample{Value: 12.5}}); payload != "12.5" {
+		t.Errorf("expected 12.5, got %s", payload)
+	}
+}
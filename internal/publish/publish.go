@@ -0,0 +1,46 @@
+package publish
+
+import (
+	"context"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/report"
+)
+
+// point is a single value to publish, along with the metric it belongs to
+type point struct {
+	metric report.Metric
+	sample report.Sample
+}
+
+// points flattens the latest sample into the values allowed by the filter, in the order of the metrics
+func points(sample report.Report, units conf.Units, filter report.Filter) []point {
+	var flattened []point
+	for _, metric := range report.FilterMetrics(report.Metrics(sample, units), filter) {
+		for _, s := range metric.Samples {
+			flattened = append(flattened, point{metric: metric, sample: s})
+		}
+	}
+	return flattened
+}
+
+// every calls publish with the latest sample on each tick, until the context is cancelled.
+// The first call waits for the sampler to have taken its first sample.
+func every(ctx context.Context, interval time.Duration, sampler *report.Sampler, publish func(report.Report)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sample, err := sampler.Report(ctx)
+			if err != nil {
+				return
+			}
+			publish(sample)
+		}
+	}
+}
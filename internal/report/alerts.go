@@ -0,0 +1,394 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+)
+
+const (
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// resolved alerts are kept for this long, and at most this many of them
+const alertResolvedRetention = 24 * time.Hour
+const alertResolvedMax = 100
+
+// "disk" stands for every disk, wherever it is in the report
+var alertPathAliases = map[string][][]string{
+	"disk": {{arrayLabel}, {cacheLabel}, {"pools", wildcard, "disks"}},
+}
+
+type Alert struct {
+	Name       string     `json:"name"`
+	Severity   string     `json:"severity"`
+	Expr       string     `json:"expr"`
+	Path       string     `json:"path"`
+	State      string     `json:"state"`
+	Value      any        `json:"value"`
+	Since      time.Time  `json:"since"`
+	FiredAt    *time.Time `json:"fired_at"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+}
+
+type AlertsReport struct {
+	Active   []Alert `json:"active"`
+	Pending  []Alert `json:"pending"`
+	Resolved []Alert `json:"resolved"`
+}
+
+type alertRule struct {
+	name       string
+	severity   string
+	expr       string
+	paths      [][]string
+	operator   string
+	threshold  any
+	duration   time.Duration
+	hysteresis float64
+}
+
+var alertOperators = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// parseAlertRule parses expressions such as "cpu.temp > 80", "parity.is_spinning == false" or "disk.status != DISK_OK",
+// optionally followed by a duration as in "cpu.temp > 80 for 2m"
+func parseAlertRule(rule conf.AlertRule) (alertRule, error) {
+	parsed := alertRule{name: rule.Name, severity: rule.Severity, expr: rule.Expr, duration: rule.For, hysteresis: rule.Hysteresis}
+
+	expr := rule.Expr
+	if before, after, found := strings.Cut(expr, " for "); found {
+		duration, err := time.ParseDuration(strings.TrimSpace(after))
+		if err != nil {
+			return parsed, fmt.Errorf("unable to parse duration %s", after)
+		}
+		expr = before
+		parsed.duration = duration
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 3 {
+		return parsed, fmt.Errorf("expected <path> <operator> <value>")
+	}
+	path, operator, value := fields[0], fields[1], strings.Trim(fields[2], "\"'")
+
+	for _, candidate := range alertOperators {
+		if operator == candidate {
+			parsed.operator = operator
+		}
+	}
+	if parsed.operator == "" {
+		return parsed, fmt.Errorf("unknown operator %s, expected one of %v", operator, alertOperators)
+	}
+
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		parsed.threshold = number
+	} else if boolean, err := strconv.ParseBool(value); err == nil {
+		parsed.threshold = boolean
+	} else {
+		parsed.threshold = value
+	}
+	if _, isNumber := parsed.threshold.(float64); !isNumber && operator != "==" && operator != "!=" {
+		return parsed, fmt.Errorf("operator %s requires a number", operator)
+	}
+
+	segments := strings.Split(path, ".")
+	if aliases, isAlias := alertPathAliases[segments[0]]; isAlias {
+		for _, alias := range aliases {
+			parsed.paths = append(parsed.paths, append(append([]string{}, alias...), segments[1:]...))
+		}
+	} else {
+		parsed.paths = [][]string{segments}
+	}
+	return parsed, nil
+}
+
+// holds tells whether the value satisfies the rule, the threshold being moved by the hysteresis
+// in the direction that keeps a firing alert firing
+func (rule alertRule) holds(value any, firing bool) bool {
+	threshold, isNumber := rule.threshold.(float64)
+	if !isNumber {
+		switch rule.operator {
+		case "==":
+			return value == rule.threshold
+		case "!=":
+			return value != rule.threshold
+		}
+		return false
+	}
+
+	number, ok := value.(float64)
+	if !ok {
+		return false
+	}
+	hysteresis := 0.0
+	if firing {
+		hysteresis = rule.hysteresis
+	}
+	switch rule.operator {
+	case ">":
+		return number > threshold-hysteresis
+	case ">=":
+		return number >= threshold-hysteresis
+	case "<":
+		return number < threshold+hysteresis
+	case "<=":
+		return number <= threshold+hysteresis
+	case "==":
+		return number == threshold
+	case "!=":
+		return number != threshold
+	}
+	return false
+}
+
+// AlertNotifier is told about every alert that starts firing or gets resolved, it must not block
+type AlertNotifier interface {
+	Notify(alert Alert)
+}
+
+// AlertEngine evaluates the rules against every sample, values being read from the report as it is served,
+// with the same paths used to include or exclude parts of it.
+type AlertEngine struct {
+	rules    []alertRule
+	notifier AlertNotifier
+	mu       sync.Mutex
+	active   map[string]*Alert
+	resolved []Alert
+}
+
+func NewAlertEngine(rules []conf.AlertRule) *AlertEngine {
+	engine := &AlertEngine{active: make(map[string]*Alert), resolved: make([]Alert, 0)}
+	for _, rule := range rules {
+		parsed, err := parseAlertRule(rule)
+		if err != nil {
+			slog.Error("Alert rule ignored", slog.String("name", rule.Name), slog.String("expr", rule.Expr), slog.String("error", err.Error()))
+			continue
+		}
+		slog.Info("Alert rule", "name", parsed.name, "expr", parsed.expr, "for", parsed.duration, "severity", parsed.severity)
+		engine.rules = append(engine.rules, parsed)
+	}
+	return engine
+}
+
+func (engine *AlertEngine) SetNotifier(notifier AlertNotifier) {
+	if engine == nil {
+		return
+	}
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	engine.notifier = notifier
+}
+
+// Needs reports whether a rule reads anything at or below the path, so that its collector runs
+func (engine *AlertEngine) Needs(path ...string) bool {
+	if engine == nil {
+		return false
+	}
+	for _, rule := range engine.rules {
+		for _, rulePath := range rule.paths {
+			compatible := true
+			for i := 0; i < min(len(path), len(rulePath)); i++ {
+				if path[i] != rulePath[i] && path[i] != wildcard && rulePath[i] != wildcard {
+					compatible = false
+					break
+				}
+			}
+			if compatible {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Evaluate updates the alerts with the report and returns the firing ones
+func (engine *AlertEngine) Evaluate(report Report, now time.Time) []Alert {
+	if engine == nil || len(engine.rules) == 0 {
+		return make([]Alert, 0)
+	}
+
+	marshalled, err := json.Marshal(report)
+	var generic any
+	if err == nil {
+		err = json.Unmarshal(marshalled, &generic)
+	}
+	if err != nil {
+		slog.Error("Alert unable to read report", slog.String("error", err.Error()))
+		return make([]Alert, 0)
+	}
+
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, rule := range engine.rules {
+		for _, rulePath := range rule.paths {
+			walkAlertPath(generic, rulePath, nil, func(path []string, value any) {
+				key := rule.name + "|" + strings.Join(path, ".")
+				seen[key] = true
+				engine.update(rule, key, strings.Join(path, "."), value, now)
+			})
+		}
+	}
+
+	// values that disappeared, e.g. a disk that has been removed, no longer hold
+	for key, alert := range engine.active {
+		if !seen[key] {
+			engine.clear(key, alert, now)
+		}
+	}
+
+	engine.pruneResolved(now)
+	return engine.alertsIn(AlertFiring)
+}
+
+func (engine *AlertEngine) update(rule alertRule, key string, path string, value any, now time.Time) {
+	alert, exists := engine.active[key]
+	firing := exists && alert.State == AlertFiring
+
+	if !rule.holds(value, firing) {
+		if exists {
+			engine.clear(key, alert, now)
+		}
+		return
+	}
+
+	if !exists {
+		alert = &Alert{Name: rule.name, Severity: rule.severity, Expr: rule.expr, Path: path, State: AlertPending, Since: now}
+		engine.active[key] = alert
+	}
+	alert.Value = value
+	if alert.State == AlertPending && now.Sub(alert.Since) >= rule.duration {
+		firedAt := now
+		alert.State = AlertFiring
+		alert.FiredAt = &firedAt
+		slog.Warn("Alert firing", "name", alert.Name, "path", alert.Path, "value", value, "severity", alert.Severity)
+		if engine.notifier != nil {
+			engine.notifier.Notify(*alert)
+		}
+	}
+}
+
+// clear forgets a pending alert, and resolves a firing one
+func (engine *AlertEngine) clear(key string, alert *Alert, now time.Time) {
+	delete(engine.active, key)
+	if alert.State != AlertFiring {
+		return
+	}
+	resolvedAt := now
+	alert.State = AlertResolved
+	alert.ResolvedAt = &resolvedAt
+	engine.resolved = append(engine.resolved, *alert)
+	slog.Info("Alert resolved", "name", alert.Name, "path", alert.Path, "value", alert.Value)
+	if engine.notifier != nil {
+		engine.notifier.Notify(*alert)
+	}
+}
+
+func (engine *AlertEngine) pruneResolved(now time.Time) {
+	first := max(0, len(engine.resolved)-alertResolvedMax)
+	for first < len(engine.resolved) && now.Sub(*engine.resolved[first].ResolvedAt) > alertResolvedRetention {
+		first++
+	}
+	engine.resolved = engine.resolved[first:]
+}
+
+func (engine *AlertEngine) alertsIn(state string) []Alert {
+	alerts := make([]Alert, 0)
+	for _, alert := range engine.active {
+		if alert.State == state {
+			alerts = append(alerts, *alert)
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Since.Equal(alerts[j].Since) {
+			return alerts[i].Path < alerts[j].Path
+		}
+		return alerts[i].Since.Before(alerts[j].Since)
+	})
+	return alerts
+}
+
+// Report returns the firing and pending alerts, and the ones resolved recently, most recent first
+// AllowedAlerts keeps the alerts on a path the filter allows, so that reading the alerts does not reveal the values it hides
+func AllowedAlerts(alerts []Alert, filter Filter) []Alert {
+	if alerts == nil {
+		return nil
+	}
+	allowed := make([]Alert, 0, len(alerts))
+	for _, alert := range alerts {
+		if filter.Allows(strings.Split(alert.Path, ".")...) {
+			allowed = append(allowed, alert)
+		}
+	}
+	return allowed
+}
+
+// Allowed returns the alerts on a path the filter allows
+func (alerts AlertsReport) Allowed(filter Filter) AlertsReport {
+	return AlertsReport{
+		Active:   AllowedAlerts(alerts.Active, filter),
+		Pending:  AllowedAlerts(alerts.Pending, filter),
+		Resolved: AllowedAlerts(alerts.Resolved, filter),
+	}
+}
+
+func (engine *AlertEngine) Report() AlertsReport {
+	if engine == nil {
+		return AlertsReport{Active: make([]Alert, 0), Pending: make([]Alert, 0), Resolved: make([]Alert, 0)}
+	}
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	resolved := make([]Alert, 0, len(engine.resolved))
+	for i := len(engine.resolved) - 1; i >= 0; i-- {
+		resolved = append(resolved, engine.resolved[i])
+	}
+	return AlertsReport{Active: engine.alertsIn(AlertFiring), Pending: engine.alertsIn(AlertPending), Resolved: resolved}
+}
+
+// walkAlertPath calls found with every value at the path. Elements of a list are matched by their id as in the filter,
+// a segment matching none of them applies to all of them, so that "parity.is_spinning" reads every parity disk.
+func walkAlertPath(value any, segments []string, path []string, found func([]string, any)) {
+	if len(segments) == 0 {
+		found(path, value)
+		return
+	}
+	child := func(segment string) []string {
+		return append(append([]string{}, path...), segment)
+	}
+
+	switch value := value.(type) {
+	case map[string]any:
+		if segments[0] == wildcard {
+			for key, element := range value {
+				walkAlertPath(element, segments[1:], child(key), found)
+			}
+		} else if element, exists := value[segments[0]]; exists {
+			walkAlertPath(element, segments[1:], child(segments[0]), found)
+		}
+	case []any:
+		matched := false
+		for _, element := range value {
+			id := elementId(element)
+			if segments[0] == wildcard || segments[0] == id {
+				matched = true
+				walkAlertPath(element, segments[1:], child(id), found)
+			}
+		}
+		if !matched {
+			for _, element := range value {
+				walkAlertPath(element, segments, child(elementId(element)), found)
+			}
+		}
+	}
+}
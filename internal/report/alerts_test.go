@@ -0,0 +1,69 @@
+package report
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/monitor"
+)
+
+func TestAlertEngine(t *testing.T) {
+	engine := NewAlertEngine([]conf.AlertRule{
+		{Name: "cpu_hot", Expr: "cpu.temp > 80 for 2m", Severity: "critical", Hysteresis: 5},
+		{Name: "disk_hot", Expr: "disk.temp > 50", Severity: "warning"},
+		{Name: "parity_spinning", Expr: "parity.is_spinning == true", Severity: "info"},
+		{Name: "invalid", Expr: "cpu.temp >> 80"},
+	})
+	if len(engine.rules) != 3 {
+		t.Fatalf("expected the invalid rule to be ignored, got %d rules", len(engine.rules))
+	}
+
+	start := time.Unix(1700000000, 0)
+	sample := func(cpuTemp int, diskTemp int, paritySpinning bool) Report {
+		return Report{
+			Cpu:    monitor.CpuStatus{Temp: cpuTemp},
+			Pools:  []monitor.PoolStatus{{Name: "fast", Disks: []monitor.DiskStatus{{Path: "/mnt/fast", Temp: uint64(diskTemp)}}}},
+			Parity: []monitor.ParityStatus{{Name: "parity", IsSpinning: paritySpinning}},
+		}
+	}
+	names := func(alerts []Alert) (names []string) {
+		for _, alert := range alerts {
+			names = append(names, alert.Name+" "+alert.Path)
+		}
+		return
+	}
+
+	firing := engine.Evaluate(sample(85, 55, false), start)
+	if len(firing) != 1 || firing[0].Path != "pools.fast.disks.fast.temp" {
+		t.Fatalf("expected only the disk alert to fire, got %v", names(firing))
+	}
+	if pending := engine.Report().Pending; len(pending) != 1 || pending[0].Name != "cpu_hot" {
+		t.Fatalf("expected the cpu alert to be pending, got %v", names(pending))
+	}
+
+	firing = engine.Evaluate(sample(85, 55, true), start.Add(2*time.Minute))
+	if len(firing) != 3 {
+		t.Fatalf("expected 3 alerts to fire, got %v", names(firing))
+	}
+
+	// within the hysteresis the cpu alert keeps firing, the disk one resolves at once
+	firing = engine.Evaluate(sample(78, 50, true), start.Add(3*time.Minute))
+	if len(firing) != 2 || firing[0].Name != "cpu_hot" || firing[1].Name != "parity_spinning" {
+		t.Fatalf("expected the cpu and parity alerts to keep firing, got %v", names(firing))
+	}
+
+	// the cpu cools down past the hysteresis, the parity disk disappears from the report
+	firing = engine.Evaluate(Report{Cpu: monitor.CpuStatus{Temp: 74}}, start.Add(4*time.Minute))
+	if len(firing) != 0 {
+		t.Fatalf("expected no alert to fire, got %v", names(firing))
+	}
+	resolved := engine.Report().Resolved
+	if len(resolved) != 3 || resolved[0].ResolvedAt == nil || !resolved[0].ResolvedAt.Equal(start.Add(4*time.Minute)) {
+		t.Fatalf("expected 3 resolved alerts, most recent first, got %v", names(resolved))
+	}
+
+	if !engine.Needs("pools", "fast") || !engine.Needs("cpu") || engine.Needs("memory") {
+		t.Fatalf("expected the engine to need the pools and the cpu only")
+	}
+}
@@ -0,0 +1,160 @@
+package report
+
+import (
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/monitor"
+)
+
+type Collector struct {
+	NetworkMonitor     monitor.NetworkMonitor
+	DiskMonitor        monitor.DiskMonitor
+	ParityCheckMonitor *monitor.ParityCheckMonitor
+	ZfsMonitor         monitor.ZfsMonitor
+	ShareMonitor       *monitor.ShareMonitor
+	Forecaster         *Forecaster
+	Alerts             *AlertEngine
+	CpuMonitor         monitor.CpuMonitor
+	MemoryMonitor      monitor.MemoryMonitor
+	Filter             Filter
+}
+
+// NewCollector only creates the monitors whose output is not excluded by the configuration.
+func NewCollector(conf conf.Conf) *Collector {
+	collector := &Collector{Filter: NewFilter(conf.Include, conf.Exclude)}
+	if len(conf.Alerts) > 0 {
+		collector.Alerts = NewAlertEngine(conf.Alerts)
+	}
+	if collector.needsDisks() {
+		collector.DiskMonitor = monitor.NewDiskMonitor(conf.Disks, conf.Units, conf.Smart)
+		collector.Forecaster = NewForecaster(conf.Forecast, conf.Units)
+	}
+	if collector.needsParityCheck() {
+		collector.ParityCheckMonitor = monitor.NewParityCheckMonitor()
+	}
+	if collector.needsShares() {
+		collector.ShareMonitor = monitor.NewShareMonitor(conf.Units, conf.Shares)
+	}
+	if collector.needsZfs() {
+		collector.ZfsMonitor = monitor.NewZfsMonitor(conf.Units)
+	}
+	if collector.needsNetwork() {
+		collector.NetworkMonitor = monitor.NewNetworkMonitor(conf.Networks)
+	}
+	if collector.needsCpu() {
+		collector.CpuMonitor = monitor.NewCpuMonitor(conf.CpuTemp)
+	}
+	if collector.needsMemory() {
+		collector.MemoryMonitor = monitor.NewMemoryMonitor(conf.Units.Memory)
+	}
+	return collector
+}
+
+// needs reports whether anything at or below the path is part of the output or read by an alert rule
+func (c *Collector) needs(path ...string) bool {
+	return c.Filter.Needs(path...) || c.Alerts.Needs(path...)
+}
+
+// needsPool also returns true when shares are needed, as their free space comes from the disks
+func (c *Collector) needsPool(name string) bool {
+	if c.needsShares() {
+		return true
+	}
+	switch name {
+	case arrayLabel:
+		return c.needs(arrayLabel) || c.needs(arrayLabel+"_total")
+	case cacheLabel:
+		return c.needs(cacheLabel) || c.needs(cacheLabel+"_total")
+	}
+	return c.needs("pools", name)
+}
+
+func (c *Collector) needsParity() bool {
+	return c.needs("parity")
+}
+
+func (c *Collector) needsParityCheck() bool {
+	return c.needs("parity_check")
+}
+
+func (c *Collector) needsArrayState() bool {
+	return c.needs("array_state")
+}
+
+func (c *Collector) needsShares() bool {
+	return c.needs("shares")
+}
+
+func (c *Collector) needsZfs() bool {
+	return c.needs("zfs")
+}
+
+func (c *Collector) needsDisks() bool {
+	return c.needsPool(arrayLabel) || c.needsPool(cacheLabel) || c.needs("pools") || c.needsParity()
+}
+
+func (c *Collector) needsNetwork() bool {
+	return c.needs("network") || c.needs("network_total")
+}
+
+func (c *Collector) needsCpu() bool {
+	return c.needs("cpu") || c.needs("cores")
+}
+
+func (c *Collector) needsMemory() bool {
+	return c.needs("memory")
+}
+
+// Collect runs every monitor that is needed, CPU and network rates cover the time since the previous call.
+func (c *Collector) Collect() (report Report) {
+	if c.needsDisks() {
+		diskUsage := c.DiskMonitor.ComputeSelectedDiskUsage(c.needsPool, c.needsParity())
+		report.Array = diskUsage.Array
+		report.Cache = diskUsage.Cache
+		report.CacheBtrfs = diskUsage.CacheBtrfs
+		report.Pools = diskUsage.Pools
+		report.Parity = diskUsage.Party
+		report.ArrayTotal = monitor.AggregateDiskStatuses(diskUsage.Array)
+		report.CacheTotal = monitor.AggregateDiskStatuses(diskUsage.Cache)
+		c.Forecaster.Apply(&report, time.Now())
+	}
+
+	if c.needsShares() {
+		pools := make([]monitor.PoolStatus, 0, len(report.Pools)+2)
+		for _, name := range []string{arrayLabel, cacheLabel} {
+			if pool, found := report.Pool(name); found {
+				pools = append(pools, pool)
+			}
+		}
+		report.Shares = c.ShareMonitor.ComputeShares(append(pools, report.Pools...))
+	}
+
+	if c.needsArrayState() {
+		report.ArrayState = monitor.ReadArrayState()
+	}
+
+	if c.needsParityCheck() {
+		report.ParityCheck = c.ParityCheckMonitor.ComputeParityCheckStatus()
+	}
+
+	if c.needsZfs() {
+		report.Zfs = c.ZfsMonitor.ComputeZfsStatus()
+	}
+
+	if c.needsNetwork() {
+		report.Network = c.NetworkMonitor.ComputeNetworkRate()
+		report.NetworkTotal = monitor.AggregateNetworkRates(report.Network)
+	}
+
+	if c.needsCpu() {
+		report.Cpu, report.Cores = c.CpuMonitor.ComputeCpuStatus()
+	}
+
+	if c.needsMemory() {
+		report.Memory = c.MemoryMonitor.ComputeMemoryUsage()
+	}
+
+	report.Alerts = c.Alerts.Evaluate(report, time.Now())
+	return
+}
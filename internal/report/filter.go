@@ -0,0 +1,201 @@
+package report
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+)
+
+const wildcard = "*"
+
+// Filter decides which parts of the report are returned, based on dotted paths such as
+// "cpu", "network.eth1" or "array.disk1.temp". Elements of a list are matched by their
+// interface, name or the last part of their mount, "*" matches anything.
+type Filter struct {
+	include [][]string
+	exclude [][]string
+	// filters that must allow the paths as well
+	scopes []Filter
+}
+
+func NewFilter(include []string, exclude []string) Filter {
+	split := func(paths []string) [][]string {
+		split := make([][]string, 0, len(paths))
+		for _, path := range paths {
+			path = strings.TrimSpace(path)
+			if path != "" {
+				split = append(split, strings.Split(path, "."))
+			}
+		}
+		return split
+	}
+	return Filter{include: split(include), exclude: split(exclude)}
+}
+
+// Within returns a filter only allowing what both the filter and the scope allow,
+// e.g. the configured filter restricted to what an API token may read.
+func (f Filter) Within(scope Filter) Filter {
+	f.scopes = append(append([]Filter{}, f.scopes...), scope)
+	return f
+}
+
+// metadata keys are never filtered out
+var metadata = map[string]bool{"error": true, "sampled_at": true}
+
+func matches(rule []string, path []string) bool {
+	if len(rule) > len(path) {
+		return false
+	}
+	for i, segment := range rule {
+		if segment != wildcard && segment != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f Filter) excluded(path []string) bool {
+	for _, rule := range f.exclude {
+		if matches(rule, path) {
+			return true
+		}
+	}
+	for _, scope := range f.scopes {
+		if scope.excluded(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// included is true if the path, or one of its ancestors, has been included
+func (f Filter) included(path []string) bool {
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, rule := range f.include {
+		if matches(rule, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// leadsToInclusion is true if one of the path's descendants has been included
+func (f Filter) leadsToInclusion(path []string) bool {
+	for _, rule := range f.include {
+		if len(rule) > len(path) && matches(path, rule[:len(path)]) {
+			return true
+		}
+	}
+	return false
+}
+
+// includesAll is true if everything at or below the path is part of the output
+func (f Filter) includesAll(path []string) bool {
+	if len(f.exclude) > 0 || !f.included(path) {
+		return false
+	}
+	for _, scope := range f.scopes {
+		if !scope.includesAll(path) {
+			return false
+		}
+	}
+	return true
+}
+
+// Allows reports whether the value at the given path is part of the output.
+func (f Filter) Allows(path ...string) bool {
+	for _, scope := range f.scopes {
+		if !scope.Allows(path...) {
+			return false
+		}
+	}
+	return !f.excluded(path) && f.included(path)
+}
+
+// Needs reports whether anything at or below the given path is part of the output,
+// it is used to avoid running collectors whose output would be discarded.
+func (f Filter) Needs(path ...string) bool {
+	for _, scope := range f.scopes {
+		if !scope.Needs(path...) {
+			return false
+		}
+	}
+	return !f.excluded(path) && (f.included(path) || f.leadsToInclusion(path))
+}
+
+func (f Filter) IsEmpty() bool {
+	for _, scope := range f.scopes {
+		if !scope.IsEmpty() {
+			return false
+		}
+	}
+	return len(f.include) == 0 && len(f.exclude) == 0
+}
+
+// Apply returns the JSON representation of the value, without the filtered out parts.
+// The prefix is the path of the value within the report.
+func (f Filter) Apply(value any, prefix ...string) (any, error) {
+	if f.IsEmpty() {
+		return value, nil
+	}
+	marshalled, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var generic any
+	if err := json.Unmarshal(marshalled, &generic); err != nil {
+		return nil, err
+	}
+	return f.prune(generic, prefix), nil
+}
+
+func (f Filter) prune(value any, path []string) any {
+	if f.excluded(path) {
+		return nil
+	}
+	if f.includesAll(path) {
+		return value
+	}
+
+	switch value := value.(type) {
+	case map[string]any:
+		pruned := make(map[string]any, len(value))
+		for key, child := range value {
+			childPath := append(append([]string{}, path...), key)
+			if (len(path) == 0 && metadata[key]) || f.Needs(childPath...) {
+				pruned[key] = f.prune(child, childPath)
+			}
+		}
+		return pruned
+	case []any:
+		pruned := make([]any, 0, len(value))
+		for _, child := range value {
+			childPath := append(append([]string{}, path...), elementId(child))
+			if f.Needs(childPath...) {
+				pruned = append(pruned, f.prune(child, childPath))
+			}
+		}
+		return pruned
+	default:
+		return value
+	}
+}
+
+// elementId identifies an element of a list, e.g. "eth0" for a network or "disk1" for /mnt/disk1
+func elementId(element any) string {
+	object, ok := element.(map[string]any)
+	if !ok {
+		return ""
+	}
+	for _, key := range []string{"interface", "name"} {
+		if id, ok := object[key].(string); ok && id != "" {
+			return id
+		}
+	}
+	if mount, ok := object["mount"].(string); ok && mount != "" {
+		return filepath.Base(mount)
+	}
+	return ""
+}
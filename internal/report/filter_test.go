@@ -0,0 +1,107 @@
+package report
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/monitor"
+)
+
+func filterTestReport() Report {
+	return Report{
+		Array: []monitor.DiskStatus{
+			{Path: "/mnt/disk1", Temp: 30, Id: "id1"},
+			{Path: "/mnt/disk2", Temp: 31, Id: "id2"},
+		},
+		Network: []monitor.NetworkRate{{Iname: "eth0"}, {Iname: "eth1"}},
+		Cpu:     monitor.CpuStatus{LoadPercent: 10, Temp: 40},
+		Cores:   []monitor.CoreStatus{{Name: "cpu0"}},
+	}
+}
+
+func applyToJson(t *testing.T, filter Filter, value any) string {
+	filtered, err := filter.Apply(value)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	marshalled, err := json.Marshal(filtered)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return string(marshalled)
+}
+
+func TestFilterExclude(t *testing.T) {
+	filter := NewFilter(nil, []string{"array", "cache", "pools", "parity", "parity_check", "array_state", "zfs", "shares", "alerts", "array_total", "cache_total",
+		"network_total", "memory", "cores", "network.eth1", "cpu.temp"})
+
+	expected := `{"cpu":{"load_percent":10},"error":null,"network":[{"interface":"eth0","rx_Mbps":0,"rx_MiBs":0,"tx_Mbps":0,"tx_MiBs":0}],"sampled_at":"0001-01-01T00:00:00Z"}`
+	res := applyToJson(t, filter, filterTestReport())
+	if res != expected {
+		t.Fatalf("expected: %s, got: %s", expected, res)
+	}
+}
+
+func TestFilterInclude(t *testing.T) {
+	filter := NewFilter([]string{"cpu", "array.disk2.temp"}, nil)
+
+	expected := `{"array":[{"temp":31}],"cpu":{"load_percent":10,"temp":40},"error":null,"sampled_at":"0001-01-01T00:00:00Z"}`
+	res := applyToJson(t, filter, filterTestReport())
+	if res != expected {
+		t.Fatalf("expected: %s, got: %s", expected, res)
+	}
+}
+
+func TestFilterWildcard(t *testing.T) {
+	filter := NewFilter([]string{"array"}, []string{"array.*.disk_id", "array.*.mount"})
+
+	expected := `{"array":[{"device":"","estimated_full_at":null,"free":0,"free_percent":0,"fs_type":"","growth_per_day":0,"is_spinning":false,"num_errors":0,"num_reads":0,"num_writes":0,` +
+		`"rotational":false,"status":"","temp":30,"total":0,"used":0,"used_percent":0},` +
+		`{"device":"","estimated_full_at":null,"free":0,"free_percent":0,"fs_type":"","growth_per_day":0,"is_spinning":false,"num_errors":0,"num_reads":0,"num_writes":0,` +
+		`"rotational":false,"status":"","temp":31,"total":0,"used":0,"used_percent":0}],"error":null,"sampled_at":"0001-01-01T00:00:00Z"}`
+	res := applyToJson(t, filter, filterTestReport())
+	if res != expected {
+		t.Fatalf("expected: %s, got: %s", expected, res)
+	}
+}
+
+func TestFilterNeeds(t *testing.T) {
+	filter := NewFilter([]string{"array_total", "pools.fast.total"}, []string{"cpu"})
+
+	tests := []struct {
+		path     []string
+		expected bool
+	}{
+		{[]string{"array_total"}, true},
+		{[]string{"array"}, false},
+		{[]string{"pools"}, true},
+		{[]string{"pools", "fast"}, true},
+		{[]string{"pools", "slow"}, false},
+		{[]string{"cpu"}, false},
+		{[]string{"memory"}, false},
+	}
+
+	for _, tc := range tests {
+		if res := filter.Needs(tc.path...); res != tc.expected {
+			t.Errorf("path %v expected: %t, got: %t", tc.path, tc.expected, res)
+		}
+	}
+}
+
+func TestFilterWithin(t *testing.T) {
+	filter := NewFilter([]string{"cpu", "array"}, []string{"cpu.temp"}).Within(NewFilter([]string{"cpu", "network"}, nil))
+
+	expected := `{"cpu":{"load_percent":10},"error":null,"sampled_at":"0001-01-01T00:00:00Z"}`
+	res := applyToJson(t, filter, filterTestReport())
+	if res != expected {
+		t.Fatalf("expected: %s, got: %s", expected, res)
+	}
+	if filter.Needs("array") || filter.Needs("network") || !filter.Needs("cpu") {
+		t.Fatalf("expected only cpu to be needed")
+	}
+
+	scoped := NewFilter(nil, nil).Within(NewFilter(nil, []string{"array.*.disk_id"}))
+	if scoped.IsEmpty() || scoped.Allows("array", "disk1", "disk_id") || !scoped.Allows("array", "disk1", "temp") {
+		t.Fatalf("expected the scope exclusions to apply")
+	}
+}
@@ -0,0 +1,185 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/monitor"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/util"
+)
+
+// a point is recorded at most once per interval, keeping the history file small
+const forecastRecordInterval = time.Hour
+
+// no forecast is made until the history spans at least this long, shorter ones are too noisy
+const forecastMinimumSpan = 24 * time.Hour
+
+type forecastPoint struct {
+	Ts   int64   `json:"ts"`
+	Used float64 `json:"used"`
+}
+
+// Forecaster records the used space of every disk and pool over time, persisting it to a file,
+// and estimates when they will be full by fitting a line through it.
+type Forecaster struct {
+	path    string
+	window  time.Duration
+	toBytes util.MapWithDefault[string, func(float64) float64]
+	history map[string][]forecastPoint
+}
+
+func NewForecaster(forecast conf.Forecast, units conf.Units) *Forecaster {
+	forecaster := &Forecaster{
+		path:   forecast.Path,
+		window: forecast.Window,
+		toBytes: util.NewMapWithDefault(
+			map[string]func(float64) float64{
+				arrayLabel: util.SizeConvertionFunction(units.Array, util.BYTE),
+				cacheLabel: util.SizeConvertionFunction(units.Cache, util.BYTE),
+			},
+			util.SizeConvertionFunction(units.Pools, util.BYTE),
+		),
+		history: make(map[string][]forecastPoint),
+	}
+
+	content, err := os.ReadFile(forecast.Path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Forecast unable to read history", slog.String("path", forecast.Path), slog.String("error", err.Error()))
+		}
+	} else if err := json.Unmarshal(content, &forecaster.history); err != nil {
+		slog.Error("Forecast unable to parse history, starting over", slog.String("path", forecast.Path), slog.String("error", err.Error()))
+		forecaster.history = make(map[string][]forecastPoint)
+	}
+
+	return forecaster
+}
+
+// Apply records the disks and pools of the report and sets their forecast.
+func (forecaster *Forecaster) Apply(report *Report, now time.Time) {
+	recorded := false
+	apply := func(key string, pool string, status *monitor.DiskStatus) {
+		// the disk could not be read, recording 0 used would skew the forecast
+		if status.Total == 0 {
+			return
+		}
+		if forecaster.record(key, forecaster.toBytes.Get(pool)(status.Used), now) {
+			recorded = true
+		}
+		forecaster.forecast(key, pool, status, now)
+	}
+
+	for i := range report.Array {
+		apply(arrayLabel+"/"+filepath.Base(report.Array[i].Path), arrayLabel, &report.Array[i])
+	}
+	for i := range report.Cache {
+		apply(cacheLabel+"/"+filepath.Base(report.Cache[i].Path), cacheLabel, &report.Cache[i])
+	}
+	if len(report.Array) > 0 {
+		apply(arrayLabel+"_total", arrayLabel, &report.ArrayTotal)
+	}
+	if len(report.Cache) > 0 {
+		apply(cacheLabel+"_total", cacheLabel, &report.CacheTotal)
+	}
+	for i := range report.Pools {
+		pool := &report.Pools[i]
+		for j := range pool.Disks {
+			apply("pools/"+pool.Name+"/"+filepath.Base(pool.Disks[j].Path), pool.Name, &pool.Disks[j])
+		}
+		apply("pools/"+pool.Name+"/total", pool.Name, &pool.Total)
+	}
+
+	if recorded {
+		forecaster.save(now)
+	}
+}
+
+// record adds a point if the last one is older than the record interval, returning whether it did
+func (forecaster *Forecaster) record(key string, used float64, now time.Time) bool {
+	points := forecaster.history[key]
+	if len(points) > 0 && now.Sub(time.Unix(points[len(points)-1].Ts, 0)) < forecastRecordInterval {
+		return false
+	}
+	forecaster.history[key] = append(points, forecastPoint{Ts: now.Unix(), Used: used})
+	return true
+}
+
+func (forecaster *Forecaster) forecast(key string, pool string, status *monitor.DiskStatus, now time.Time) {
+	points := forecaster.history[key]
+	if len(points) < 2 || time.Duration(points[len(points)-1].Ts-points[0].Ts)*time.Second < forecastMinimumSpan {
+		return
+	}
+
+	bytesPerSecond := linearSlope(points)
+	toBytes := forecaster.toBytes.Get(pool)
+	// the conversion is linear, converting one unit gives the ratio between bytes and the configured unit
+	bytesPerUnit := toBytes(1)
+	if bytesPerUnit <= 0 {
+		return
+	}
+
+	status.GrowthPerDay = bytesPerSecond * (24 * 60 * 60) / bytesPerUnit
+	freeBytes := toBytes(status.Free)
+	if bytesPerSecond > 0 && freeBytes > 0 {
+		fullAt := now.Add(time.Duration(freeBytes / bytesPerSecond * float64(time.Second))).Truncate(time.Second)
+		status.EstimatedFullAt = &fullAt
+	}
+}
+
+// linearSlope fits a line through the points with the least squares method, returning its slope in used per second
+func linearSlope(points []forecastPoint) float64 {
+	n := float64(len(points))
+	t0 := points[0].Ts
+	var sumX, sumY, sumXY, sumXX float64
+	for _, point := range points {
+		x := float64(point.Ts - t0)
+		sumX += x
+		sumY += point.Used
+		sumXY += x * point.Used
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// save drops the points older than the window and writes the history, replacing the file only once fully written
+func (forecaster *Forecaster) save(now time.Time) {
+	oldest := now.Add(-forecaster.window).Unix()
+	for key, points := range forecaster.history {
+		first := 0
+		for first < len(points) && points[first].Ts < oldest {
+			first++
+		}
+		if first == len(points) {
+			delete(forecaster.history, key)
+		} else {
+			forecaster.history[key] = points[first:]
+		}
+	}
+
+	content, err := json.Marshal(forecaster.history)
+	if err != nil {
+		slog.Error("Forecast unable to marshal history", slog.String("error", err.Error()))
+		return
+	}
+
+	temporary := forecaster.path + ".tmp"
+	if err := os.WriteFile(temporary, content, 0644); err != nil {
+		slog.Error("Forecast unable to write history", slog.String("path", temporary), slog.String("error", err.Error()))
+		return
+	}
+	if err := os.Rename(temporary, forecaster.path); err != nil {
+		slog.Error("Forecast unable to write history", slog.String("path", forecaster.path), slog.String("error", err.Error()))
+		return
+	}
+	slog.Debug("Forecast history saved", "path", forecaster.path, "keys", len(forecaster.history))
+}
@@ -0,0 +1,64 @@
+package report
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/monitor"
+)
+
+func TestForecast(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "forecast.json")
+	forecast := conf.Forecast{Path: path, Window: 30 * 24 * time.Hour}
+	units := conf.Units{Array: "Gi", Cache: "Gi", Pools: "Gi"}
+	start := time.Unix(1700000000, 0)
+
+	forecaster := NewForecaster(forecast, units)
+	var report Report
+	// 1 Gi per day on a disk with 100 Gi left after two days
+	for hour := 0; hour <= 48; hour++ {
+		report = Report{Array: []monitor.DiskStatus{{Path: "/mnt/disk1", Total: 102, Used: float64(hour) / 24, Free: 102 - float64(hour)/24}}}
+		forecaster.Apply(&report, start.Add(time.Duration(hour)*time.Hour))
+	}
+
+	disk := report.Array[0]
+	if disk.GrowthPerDay < 0.999 || disk.GrowthPerDay > 1.001 {
+		t.Fatalf("expected a growth of 1 per day, got %f", disk.GrowthPerDay)
+	}
+	expectedFullAt := start.Add(48 * time.Hour).Add(100 * 24 * time.Hour)
+	if disk.EstimatedFullAt == nil || disk.EstimatedFullAt.Sub(expectedFullAt).Abs() > time.Minute {
+		t.Fatalf("expected to be full at %v, got %v", expectedFullAt, disk.EstimatedFullAt)
+	}
+
+	// the history is persisted and reloaded
+	reloaded := NewForecaster(forecast, units)
+	if len(reloaded.history["array/disk1"]) != 49 {
+		t.Fatalf("expected 49 points to be reloaded, got %d", len(reloaded.history["array/disk1"]))
+	}
+
+	// less than a day of history is not enough for a forecast
+	fresh := NewForecaster(conf.Forecast{Path: filepath.Join(t.TempDir(), "forecast.json"), Window: time.Hour * 24 * 30}, units)
+	report = Report{Array: []monitor.DiskStatus{{Path: "/mnt/disk1", Total: 2, Used: 1, Free: 1}}}
+	fresh.Apply(&report, start)
+	if report.Array[0].EstimatedFullAt != nil || report.Array[0].GrowthPerDay != 0 {
+		t.Fatalf("expected no forecast, got %+v", report.Array[0])
+	}
+
+	// a disk that could not be read is not recorded, its placeholder would look like the disk was emptied
+	unreadable := NewForecaster(conf.Forecast{Path: filepath.Join(t.TempDir(), "forecast.json"), Window: time.Hour * 24 * 30}, units)
+	for hour := 0; hour <= 48; hour += 24 {
+		report = Report{Array: []monitor.DiskStatus{{Path: "/mnt/disk1", Total: 102, Used: 50, Free: 52}}}
+		if hour == 24 {
+			report.Array[0] = monitor.DiskStatus{Path: "/mnt/disk1"}
+		}
+		unreadable.Apply(&report, start.Add(time.Duration(hour)*time.Hour))
+	}
+	if points := unreadable.history["array/disk1"]; len(points) != 2 || points[0].Used != points[1].Used {
+		t.Fatalf("expected the unreadable sample to be skipped, got %+v", points)
+	}
+	if report.Array[0].GrowthPerDay != 0 {
+		t.Fatalf("expected no growth, got %f", report.Array[0].GrowthPerDay)
+	}
+}
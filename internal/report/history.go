@@ -0,0 +1,250 @@
+package report
+
+import (
+	"errors"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+)
+
+var ErrUnknownMetric = errors.New("unknown metric")
+
+type HistoryPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Min       float64   `json:"min"`
+	Max       float64   `json:"max"`
+	Avg       float64   `json:"avg"`
+}
+
+type HistoryResult struct {
+	Metric      string         `json:"metric"`
+	From        time.Time      `json:"from"`
+	To          time.Time      `json:"to"`
+	StepSeconds float64        `json:"step_seconds"`
+	Points      []HistoryPoint `json:"points"`
+}
+
+type historyBucket struct {
+	start int64
+	min   float64
+	max   float64
+	sum   float64
+	count int
+}
+
+func (bucket *historyBucket) merge(other historyBucket) {
+	if bucket.count == 0 {
+		*bucket = historyBucket{start: bucket.start, min: other.min, max: other.max}
+	} else {
+		bucket.min = min(bucket.min, other.min)
+		bucket.max = max(bucket.max, other.max)
+	}
+	bucket.sum = bucket.sum + other.sum
+	bucket.count = bucket.count + other.count
+}
+
+// the first allocation of a ring, which then doubles up to its capacity
+const historyRingInitialSize = 16
+
+// historyRing holds the latest buckets of a metric, growing up to its capacity and then overwriting the oldest
+type historyRing struct {
+	buckets  []historyBucket
+	capacity int
+	next     int
+}
+
+func (ring *historyRing) last() *historyBucket {
+	if len(ring.buckets) == 0 {
+		return nil
+	}
+	return &ring.buckets[(ring.next-1+len(ring.buckets))%len(ring.buckets)]
+}
+
+func (ring *historyRing) oldest() *historyBucket {
+	if len(ring.buckets) == 0 {
+		return nil
+	}
+	return &ring.buckets[ring.next%len(ring.buckets)]
+}
+
+func (ring *historyRing) add(bucket historyBucket) {
+	if len(ring.buckets) < ring.capacity {
+		// grown by hand, append would allocate past the capacity
+		if len(ring.buckets) == cap(ring.buckets) {
+			buckets := make([]historyBucket, len(ring.buckets), min(max(2*len(ring.buckets), historyRingInitialSize), ring.capacity))
+			copy(buckets, ring.buckets)
+			ring.buckets = buckets
+		}
+		ring.buckets = append(ring.buckets, bucket)
+		return
+	}
+	ring.buckets[ring.next] = bucket
+	ring.next = (ring.next + 1) % ring.capacity
+}
+
+// each iterates from the oldest bucket to the newest
+func (ring *historyRing) each(f func(historyBucket)) {
+	for i := range ring.buckets {
+		f(ring.buckets[(ring.next+i)%len(ring.buckets)])
+	}
+}
+
+type historyTier struct {
+	resolution time.Duration
+	retention  time.Duration
+	capacity   int
+	series     map[string]*historyRing
+}
+
+func (tier *historyTier) record(metric string, value float64, at time.Time) {
+	ring, exists := tier.series[metric]
+	if !exists {
+		ring = &historyRing{capacity: tier.capacity}
+		tier.series[metric] = ring
+	}
+
+	sample := historyBucket{start: at.Truncate(tier.resolution).Unix(), min: value, max: value, sum: value, count: 1}
+	if last := ring.last(); last != nil && last.start == sample.start {
+		last.merge(sample)
+		return
+	}
+	ring.add(sample)
+}
+
+// History keeps the metrics of the past samples in memory, at decreasing resolutions the older they get.
+// Metrics are identified by their dotted path in the report, e.g. "cpu.load_percent" or "array.disk1.temp".
+// If a storage is set, metrics are also persisted to it, and it answers the queries the memory cannot.
+type History struct {
+	units   conf.Units
+	filter  Filter
+	storage *Storage
+	mu      sync.RWMutex
+	tiers   []*historyTier
+}
+
+// NewHistory sizes each tier for a bucket per resolution, or per sample interval when sampling less often,
+// empty buckets taking no room
+func NewHistory(history conf.History, sampleInterval time.Duration, units conf.Units, filter Filter, storage *Storage) *History {
+	tiers := make([]*historyTier, 0, len(history.Tiers))
+	for _, tier := range history.Tiers {
+		if tier.Resolution <= 0 || tier.Retention < tier.Resolution {
+			slog.Warn("History ignoring tier, its retention must be at least its resolution",
+				"resolution", tier.Resolution, "retention", tier.Retention)
+			continue
+		}
+		tiers = append(tiers, &historyTier{
+			resolution: tier.Resolution,
+			retention:  tier.Retention,
+			capacity:   max(int(tier.Retention/max(tier.Resolution, sampleInterval)), 1),
+			series:     make(map[string]*historyRing),
+		})
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].resolution < tiers[j].resolution })
+
+	for _, tier := range tiers {
+		slog.Info("History", "resolution", tier.resolution, "retention", tier.retention)
+	}
+	return &History{units: units, filter: filter, storage: storage, tiers: tiers}
+}
+
+// Storage returns where the metrics are persisted, nil if they are not
+func (history *History) Storage() *Storage {
+	return history.storage
+}
+
+// Record adds every metric of the report to all the tiers, sizes being in bytes as in the Prometheus metrics
+func (history *History) Record(report Report) {
+	metrics := FilterMetrics(Metrics(report, history.units), history.filter)
+
+	history.mu.Lock()
+	for _, metric := range metrics {
+		for _, sample := range metric.Samples {
+			path := strings.Join(sample.Path, ".")
+			for _, tier := range history.tiers {
+				tier.record(path, sample.Value, report.SampledAt)
+			}
+		}
+	}
+	history.mu.Unlock()
+
+	if history.storage != nil {
+		history.storage.Record(metrics, report.SampledAt)
+	}
+}
+
+// Query aggregates the points of the metric between from and to into buckets of step,
+// using the finest tier still holding from. A step shorter than the tier's resolution is raised to it.
+func (history *History) Query(metric string, from time.Time, to time.Time, step time.Duration, now time.Time) (HistoryResult, error) {
+	history.mu.RLock()
+	defer history.mu.RUnlock()
+
+	if len(history.tiers) == 0 {
+		if history.storage != nil {
+			return history.storage.Query(metric, from, to, step, now)
+		}
+		return HistoryResult{}, ErrUnknownMetric
+	}
+	tier := history.tiers[len(history.tiers)-1]
+	for _, candidate := range history.tiers {
+		if now.Sub(from) <= candidate.retention {
+			tier = candidate
+			break
+		}
+	}
+
+	ring, exists := tier.series[metric]
+	if !exists {
+		if history.storage != nil {
+			return history.storage.Query(metric, from, to, step, now)
+		}
+		return HistoryResult{}, ErrUnknownMetric
+	}
+
+	if history.storage != nil && ring.oldest().start > from.Add(tier.resolution).Unix() {
+		// the memory does not go back far enough, e.g. right after a restart
+		return history.storage.Query(metric, from, to, step, now)
+	}
+
+	step = max(step, tier.resolution)
+	return HistoryResult{
+		Metric:      metric,
+		From:        from,
+		To:          to,
+		StepSeconds: step.Seconds(),
+		Points:      aggregateBuckets(ring.each, from, to, tier.resolution, step),
+	}, nil
+}
+
+// aggregateBuckets merges the buckets between from and to, iterated from the oldest, into buckets of step
+func aggregateBuckets(each func(func(historyBucket)), from time.Time, to time.Time, resolution time.Duration, step time.Duration) []HistoryPoint {
+	points := make([]HistoryPoint, 0)
+	var current *historyBucket
+	flush := func() {
+		if current != nil {
+			points = append(points, HistoryPoint{
+				Timestamp: time.Unix(current.start, 0),
+				Min:       current.min,
+				Max:       current.max,
+				Avg:       current.sum / float64(current.count),
+			})
+		}
+	}
+	each(func(bucket historyBucket) {
+		at := time.Unix(bucket.start, 0)
+		if at.Before(from.Truncate(resolution)) || at.After(to) {
+			return
+		}
+		start := at.Truncate(step).Unix()
+		if current == nil || current.start != start {
+			flush()
+			current = &historyBucket{start: start}
+		}
+		current.merge(bucket)
+	})
+	flush()
+	return points
+}
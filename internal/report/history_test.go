@@ -0,0 +1,96 @@
+package report
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/monitor"
+)
+
+func TestHistory(t *testing.T) {
+	history := NewHistory(conf.History{Tiers: []conf.HistoryTier{
+		{Resolution: time.Minute, Retention: time.Hour},
+		{Resolution: time.Second, Retention: 2 * time.Minute},
+	}}, time.Second, conf.Units{Memory: "Mi"}, NewFilter(nil, nil), nil)
+
+	start := time.Unix(1700000000, 0).Truncate(time.Minute)
+	// 10, 20, ... 120 one every 10 seconds, over two minutes
+	for i := 0; i < 12; i++ {
+		history.Record(Report{
+			Cpu:       monitor.CpuStatus{LoadPercent: float64(i+1) * 10},
+			SampledAt: start.Add(time.Duration(i) * 10 * time.Second),
+		})
+	}
+	end := start.Add(2 * time.Minute)
+
+	// the finest tier still holds from, its points are aggregated into the step
+	result, err := history.Query("cpu.load_percent", start.Add(time.Minute), end, time.Minute, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []HistoryPoint{{Timestamp: start.Add(time.Minute), Min: 70, Max: 120, Avg: 95}}
+	if !reflect.DeepEqual(result.Points, expected) || result.StepSeconds != 60 {
+		t.Fatalf("expected %+v, got %+v", expected, result)
+	}
+
+	// older than the finest tier's retention, the minute tier is used and a shorter step is raised to its resolution
+	result, err = history.Query("cpu.load_percent", start, end, time.Second, end.Add(time.Hour/2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []HistoryPoint{
+		{Timestamp: start, Min: 10, Max: 60, Avg: 35},
+		{Timestamp: start.Add(time.Minute), Min: 70, Max: 120, Avg: 95},
+	}
+	if !reflect.DeepEqual(result.Points, expected) || result.StepSeconds != 60 {
+		t.Fatalf("expected %+v, got %+v", expected, result)
+	}
+
+	if _, err := history.Query("cpu.nothing", start, end, 0, end); !errors.Is(err, ErrUnknownMetric) {
+		t.Fatalf("expected an unknown metric, got %v", err)
+	}
+}
+
+func TestHistoryRetentionWithSampleInterval(t *testing.T) {
+	// sampled every 5 seconds, a 1 second resolution only ever fills one bucket out of five
+	history := NewHistory(conf.History{Tiers: []conf.HistoryTier{
+		{Resolution: time.Second, Retention: 10 * time.Minute},
+	}}, 5*time.Second, conf.Units{Memory: "Mi"}, NewFilter(nil, nil), nil)
+
+	start := time.Unix(1700000000, 0).Truncate(time.Minute)
+	for i := 0; i < 240; i++ {
+		history.Record(Report{SampledAt: start.Add(time.Duration(i) * 5 * time.Second)})
+	}
+	end := start.Add(239 * 5 * time.Second)
+
+	ring := history.tiers[0].series["cpu.load_percent"]
+	if len(ring.buckets) != 120 {
+		t.Fatalf("expected 120 buckets, got %d", len(ring.buckets))
+	}
+	if oldest := time.Unix(ring.oldest().start, 0); end.Sub(oldest) >= 10*time.Minute {
+		t.Fatalf("expected at most 10 minutes kept, the oldest bucket is %v old", end.Sub(oldest))
+	}
+}
+
+func TestHistoryRingGrowth(t *testing.T) {
+	ring := &historyRing{capacity: 1000}
+	for i := 0; i < 10; i++ {
+		ring.add(historyBucket{start: int64(i)})
+	}
+	if cap(ring.buckets) != historyRingInitialSize {
+		t.Fatalf("expected %d buckets allocated for 10 samples, got %d", historyRingInitialSize, cap(ring.buckets))
+	}
+
+	for i := 10; i < 1500; i++ {
+		ring.add(historyBucket{start: int64(i)})
+	}
+	if len(ring.buckets) != 1000 || cap(ring.buckets) != 1000 {
+		t.Fatalf("expected 1000 buckets allocated, got %d of %d", len(ring.buckets), cap(ring.buckets))
+	}
+	if ring.oldest().start != 500 || ring.last().start != 1499 {
+		t.Fatalf("expected the buckets from 500 to 1499, got %d to %d", ring.oldest().start, ring.last().start)
+	}
+}
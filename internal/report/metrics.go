@@ -0,0 +1,403 @@
+package report
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/monitor"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/util"
+)
+
+const metricPrefix = "unraid_"
+
+const gauge = "gauge"
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample carries, besides its labels, the path of the value within the report, e.g. ["array", "disk1", "temp"]
+type Sample struct {
+	Labels []Label
+	Path   []string
+	Value  float64
+	// path within the report of the labels taken from it, e.g. disk_id, which have to be allowed as well
+	labelPaths map[string][]string
+}
+
+type Metric struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+type metricSet struct {
+	metrics []*Metric
+	byName  map[string]*Metric
+	// labelPaths of the samples being added
+	labelPaths map[string][]string
+}
+
+func (set *metricSet) add(name string, help string, path []string, value float64, labels ...Label) {
+	name = metricPrefix + name
+	metric, exists := set.byName[name]
+	if !exists {
+		metric = &Metric{Name: name, Help: help, Type: gauge}
+		set.byName[name] = metric
+		set.metrics = append(set.metrics, metric)
+	}
+	metric.Samples = append(metric.Samples, Sample{Labels: labels, Path: path, Value: value, labelPaths: set.labelPaths})
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func smartHealthToFloat(health string) float64 {
+	switch health {
+	case monitor.SmartHealthPassed:
+		return 1
+	case monitor.SmartHealthFailed:
+		return 0
+	}
+	return -1
+}
+
+func diskStatusToFloat(status string) float64 {
+	switch status {
+	case monitor.DiskOk:
+		return 1
+	case "":
+		return -1
+	}
+	return 0
+}
+
+// Metrics flattens a report into a list of metrics, sizes are converted back to bytes
+// so that consumers do not need to know which units have been configured.
+func Metrics(report Report, units conf.Units) []Metric {
+	set := metricSet{byName: make(map[string]*Metric)}
+
+	path := func(parent []string, elements ...string) []string {
+		return append(append([]string{}, parent...), elements...)
+	}
+
+	addSmart := func(kind string, parent []string, smart *monitor.SmartStatus, labels []Label) {
+		if smart == nil {
+			return
+		}
+		smartPath := path(parent, "smart")
+		set.add(kind+"_smart_passed", "Whether the SMART overall health assessment passed (1), failed (0) or is unknown (-1).",
+			path(smartPath, "health"), smartHealthToFloat(smart.Health), labels...)
+		set.add(kind+"_smart_reallocated_sectors", "SMART reallocated sectors count.",
+			path(smartPath, "reallocated_sectors"), float64(smart.ReallocatedSectors), labels...)
+		set.add(kind+"_smart_pending_sectors", "SMART current pending sectors count.",
+			path(smartPath, "pending_sectors"), float64(smart.PendingSectors), labels...)
+		set.add(kind+"_smart_crc_errors", "SMART UDMA CRC errors count.",
+			path(smartPath, "crc_errors"), float64(smart.CrcErrors), labels...)
+		set.add(kind+"_smart_power_on_hours", "SMART power on hours.",
+			path(smartPath, "power_on_hours"), float64(smart.PowerOnHours), labels...)
+	}
+
+	addState := func(kind string, parent []string, status string, numErrors, numReads, numWrites uint64, labels []Label) {
+		set.add(kind+"_ok", "Whether Unraid reports the disk as DISK_OK (1), in any other status (0) or unknown (-1).",
+			path(parent, "status"), diskStatusToFloat(status), append(labels, Label{"status", status})...)
+		set.add(kind+"_errors", "Read/write errors reported by Unraid since the array was started.", path(parent, "num_errors"), float64(numErrors), labels...)
+		set.add(kind+"_reads", "Reads reported by Unraid since the array was started.", path(parent, "num_reads"), float64(numReads), labels...)
+		set.add(kind+"_writes", "Writes reported by Unraid since the array was started.", path(parent, "num_writes"), float64(numWrites), labels...)
+	}
+
+	megaBytesToBytes := util.SizeConvertionFunction(util.MEGA, util.BYTE)
+	addIo := func(kind string, parent []string, io *monitor.DiskIo, labels []Label) {
+		if io == nil {
+			return
+		}
+		ioPath := path(parent, "io")
+		set.add(kind+"_read_bytes_per_second", "Bytes read per second.", path(ioPath, "read_MBs"), megaBytesToBytes(io.ReadMBs), labels...)
+		set.add(kind+"_write_bytes_per_second", "Bytes written per second.", path(ioPath, "write_MBs"), megaBytesToBytes(io.WriteMBs), labels...)
+		set.add(kind+"_read_iops", "Read operations per second.", path(ioPath, "read_iops"), io.ReadIops, labels...)
+		set.add(kind+"_write_iops", "Write operations per second.", path(ioPath, "write_iops"), io.WriteIops, labels...)
+		set.add(kind+"_io_latency_seconds", "Average time taken by a read or write operation.", path(ioPath, "latency_ms"), io.LatencyMs/1000, labels...)
+		set.add(kind+"_io_utilization_percent", "Time spent doing I/O as a percentage, the highest among the disks for pools.", path(ioPath, "util_percent"), io.UtilPercent, labels...)
+	}
+
+	addForecast := func(kind string, parent []string, status monitor.DiskStatus, toBytes func(float64) float64, labels []Label) {
+		set.add(kind+"_growth_bytes_per_day", "Growth of the used space per day, estimated from its history.",
+			path(parent, "growth_per_day"), toBytes(status.GrowthPerDay), labels...)
+		if status.EstimatedFullAt != nil {
+			set.add(kind+"_estimated_full_timestamp_seconds", "Estimated time at which the free space will run out, as a Unix timestamp.",
+				path(parent, "estimated_full_at"), float64(status.EstimatedFullAt.Unix()), labels...)
+		}
+	}
+
+	addDisk := func(parent []string, pool string, disk monitor.DiskStatus, toBytes func(float64) float64) {
+		labels := []Label{{"pool", pool}, {"mount", disk.Path}, {"disk_id", disk.Id}}
+		diskPath := path(parent, filepath.Base(disk.Path))
+		set.labelPaths = map[string][]string{"disk_id": path(diskPath, "disk_id")}
+		set.add("disk_total_bytes", "Total size of the disk.", path(diskPath, "total"), toBytes(disk.Total), labels...)
+		set.add("disk_used_bytes", "Used space on the disk.", path(diskPath, "used"), toBytes(disk.Used), labels...)
+		set.add("disk_free_bytes", "Free space on the disk.", path(diskPath, "free"), toBytes(disk.Free), labels...)
+		set.add("disk_used_percent", "Used space on the disk as a percentage.", path(diskPath, "used_percent"), disk.UsedPercent, labels...)
+		set.add("disk_temp_celsius", "Temperature of the disk, 0 when unavailable.", path(diskPath, "temp"), float64(disk.Temp), labels...)
+		set.add("disk_spinning", "Whether the disk is spinning (1) or spun down (0).", path(diskPath, "is_spinning"), boolToFloat(disk.IsSpinning), labels...)
+		addState("disk", diskPath, disk.Status, disk.NumErrors, disk.NumReads, disk.NumWrites, labels)
+		addIo("disk", diskPath, disk.Io, labels)
+		addForecast("disk", diskPath, disk, toBytes, labels)
+		if disk.Zfs != nil {
+			set.add("disk_zfs_compress_ratio", "Compression ratio of the ZFS dataset.", path(diskPath, "zfs", "compress_ratio"), disk.Zfs.CompressRatio, labels...)
+		}
+		addSmart("disk", diskPath, disk.Smart, labels)
+		set.labelPaths = nil
+	}
+
+	addPoolTotal := func(totalPath []string, pool string, total monitor.DiskStatus, toBytes func(float64) float64) {
+		labels := []Label{{"pool", pool}}
+		set.add("pool_total_bytes", "Total size of all the disks in the pool.", path(totalPath, "total"), toBytes(total.Total), labels...)
+		set.add("pool_used_bytes", "Used space across all the disks in the pool.", path(totalPath, "used"), toBytes(total.Used), labels...)
+		set.add("pool_free_bytes", "Free space across all the disks in the pool.", path(totalPath, "free"), toBytes(total.Free), labels...)
+		set.add("pool_used_percent", "Used space across all the disks in the pool as a percentage.", path(totalPath, "used_percent"), total.UsedPercent, labels...)
+		addIo("pool", totalPath, total.Io, labels)
+		addForecast("pool", totalPath, total, toBytes, labels)
+	}
+
+	arrayToBytes := util.SizeConvertionFunction(units.Array, util.BYTE)
+	cacheToBytes := util.SizeConvertionFunction(units.Cache, util.BYTE)
+	poolsToBytes := util.SizeConvertionFunction(units.Pools, util.BYTE)
+
+	for _, disk := range report.Array {
+		addDisk([]string{"array"}, "array", disk, arrayToBytes)
+	}
+	for _, disk := range report.Cache {
+		addDisk([]string{"cache"}, "cache", disk, cacheToBytes)
+	}
+	for _, pool := range report.Pools {
+		for _, disk := range pool.Disks {
+			addDisk([]string{"pools", pool.Name, "disks"}, pool.Name, disk, poolsToBytes)
+		}
+	}
+
+	if len(report.Array) > 0 {
+		addPoolTotal([]string{"array_total"}, "array", report.ArrayTotal, arrayToBytes)
+	}
+	if len(report.Cache) > 0 {
+		addPoolTotal([]string{"cache_total"}, "cache", report.CacheTotal, cacheToBytes)
+	}
+	for _, pool := range report.Pools {
+		addPoolTotal([]string{"pools", pool.Name, "total"}, pool.Name, pool.Total, poolsToBytes)
+	}
+
+	addBtrfs := func(btrfsPath []string, pool string, btrfs *monitor.BtrfsStatus, toBytes func(float64) float64) {
+		if btrfs == nil {
+			return
+		}
+		labels := []Label{{"pool", pool}}
+		set.add("pool_btrfs_data_used_bytes", "Space used by data in the btrfs pool.", path(btrfsPath, "data", "used"), toBytes(btrfs.Data.Used), append(labels, Label{"profile", btrfs.DataProfile})...)
+		set.add("pool_btrfs_metadata_used_bytes", "Space used by metadata in the btrfs pool.", path(btrfsPath, "metadata", "used"), toBytes(btrfs.Metadata.Used), append(labels, Label{"profile", btrfs.MetadataProfile})...)
+		set.add("pool_btrfs_unallocated_bytes", "Raw space not yet allocated to any chunk in the btrfs pool.", path(btrfsPath, "unallocated"), toBytes(btrfs.Unallocated), labels...)
+		set.add("pool_btrfs_free_estimated_bytes", "Free space in the btrfs pool, taking the data profile into account.", path(btrfsPath, "free_estimated"), toBytes(btrfs.FreeEstimated), labels...)
+		for _, device := range btrfs.Devices {
+			deviceLabels := append(labels, Label{"devid", device.Devid})
+			devicePath := path(btrfsPath, "devices", device.Devid)
+			set.add("pool_btrfs_device_missing", "Whether the btrfs device is missing (1) or not (0).", path(devicePath, "missing"), boolToFloat(device.Missing), deviceLabels...)
+			set.add("pool_btrfs_device_write_errors", "Write errors of the btrfs device.", path(devicePath, "write_errors"), float64(device.WriteErrors), deviceLabels...)
+			set.add("pool_btrfs_device_read_errors", "Read errors of the btrfs device.", path(devicePath, "read_errors"), float64(device.ReadErrors), deviceLabels...)
+			set.add("pool_btrfs_device_flush_errors", "Flush errors of the btrfs device.", path(devicePath, "flush_errors"), float64(device.FlushErrors), deviceLabels...)
+			set.add("pool_btrfs_device_corruption_errors", "Corruption errors of the btrfs device.", path(devicePath, "corruption_errors"), float64(device.CorruptionErrors), deviceLabels...)
+			set.add("pool_btrfs_device_generation_errors", "Generation errors of the btrfs device.", path(devicePath, "generation_errors"), float64(device.GenerationErrors), deviceLabels...)
+		}
+	}
+	addBtrfs([]string{"cache_btrfs"}, "cache", report.CacheBtrfs, cacheToBytes)
+	for _, pool := range report.Pools {
+		addBtrfs([]string{"pools", pool.Name, "btrfs"}, pool.Name, pool.Btrfs, poolsToBytes)
+	}
+
+	for _, parity := range report.Parity {
+		labels := []Label{{"name", parity.Name}, {"disk_id", parity.Id}}
+		parityPath := []string{"parity", parity.Name}
+		set.labelPaths = map[string][]string{"disk_id": path(parityPath, "disk_id")}
+		set.add("parity_temp_celsius", "Temperature of the parity disk, 0 when unavailable.", path(parityPath, "temp"), float64(parity.Temp), labels...)
+		set.add("parity_spinning", "Whether the parity disk is spinning (1) or spun down (0).", path(parityPath, "is_spinning"), boolToFloat(parity.IsSpinning), labels...)
+		addState("parity", parityPath, parity.Status, parity.NumErrors, parity.NumReads, parity.NumWrites, labels)
+		addIo("parity", parityPath, parity.Io, labels)
+		addSmart("parity", parityPath, parity.Smart, labels)
+		set.labelPaths = nil
+	}
+
+	for _, share := range report.Shares {
+		labels := []Label{{"share", share.Name}}
+		sharePath := []string{"shares", share.Name}
+		if share.SizeUpdatedAt != nil {
+			set.add("share_size_bytes", "Size of the files in the share.", path(sharePath, "size"), arrayToBytes(share.Size), labels...)
+		}
+		set.add("share_free_bytes", "Free space on the disks the share can write to.", path(sharePath, "free"), arrayToBytes(share.Free), labels...)
+	}
+
+	arrayState := report.ArrayState
+	set.add("array_started", "Whether the array is started (1) or not (0).", []string{"array_state", "started"}, boolToFloat(arrayState.Started), Label{"md_state", arrayState.MdState})
+	set.add("array_disabled_disks", "Number of disabled disks in the array.", []string{"array_state", "num_disabled"}, float64(arrayState.NumDisabled))
+	set.add("array_missing_disks", "Number of missing disks in the array.", []string{"array_state", "num_missing"}, float64(arrayState.NumMissing))
+	set.add("array_invalid_disks", "Number of invalid disks in the array.", []string{"array_state", "num_invalid"}, float64(arrayState.NumInvalid))
+
+	parityCheck := report.ParityCheck
+	set.add("parity_check_running", "Whether a parity check, rebuild or clear is running (1) or not (0).", []string{"parity_check", "running"}, boolToFloat(parityCheck.Running), Label{"action", parityCheck.Action})
+	set.add("parity_check_progress_percent", "Progress of the running parity check as a percentage.", []string{"parity_check", "percent"}, parityCheck.Percent)
+	set.add("parity_check_speed_bytes_per_second", "Speed of the running parity check.", []string{"parity_check", "speed_MBs"}, util.SizeConvertionFunction(util.MEGA, util.BYTE)(parityCheck.SpeedMBs))
+	set.add("parity_check_eta_seconds", "Estimated time left to the running parity check.", []string{"parity_check", "eta_seconds"}, float64(parityCheck.EtaSeconds))
+	set.add("parity_check_errors", "Errors found by the running or last parity check.", []string{"parity_check", "errors"}, float64(parityCheck.Errors))
+	if last := parityCheck.LastCheck; last != nil {
+		set.add("parity_check_last_timestamp_seconds", "Time the last parity check ended, as a Unix timestamp.", []string{"parity_check", "last_check", "date"}, float64(last.Date.Unix()))
+		set.add("parity_check_last_duration_seconds", "Duration of the last parity check.", []string{"parity_check", "last_check", "duration_seconds"}, float64(last.DurationSeconds))
+		set.add("parity_check_last_errors", "Errors found by the last parity check.", []string{"parity_check", "last_check", "errors"}, float64(last.Errors))
+		set.add("parity_check_last_exit_code", "Exit code of the last parity check, 0 when successful.", []string{"parity_check", "last_check", "exit_code"}, float64(last.ExitCode))
+	}
+
+	for _, pool := range report.Zfs.Pools {
+		toBytes := poolsToBytes
+		if pool.Name == cacheLabel {
+			toBytes = cacheToBytes
+		}
+		labels := []Label{{"zpool", pool.Name}}
+		poolPath := []string{"zfs", "pools", pool.Name}
+		set.add("zfs_pool_online", "Whether the ZFS pool is ONLINE (1) or in any other state (0).", path(poolPath, "health"), boolToFloat(pool.Health == "ONLINE"), append(labels, Label{"health", pool.Health})...)
+		set.add("zfs_pool_total_bytes", "Total size of the ZFS pool.", path(poolPath, "total"), toBytes(pool.Total), labels...)
+		set.add("zfs_pool_used_bytes", "Allocated space in the ZFS pool.", path(poolPath, "used"), toBytes(pool.Used), labels...)
+		set.add("zfs_pool_free_bytes", "Free space in the ZFS pool.", path(poolPath, "free"), toBytes(pool.Free), labels...)
+		set.add("zfs_pool_fragmentation_percent", "Fragmentation of the free space in the ZFS pool.", path(poolPath, "fragmentation_percent"), pool.FragmentationPercent, labels...)
+		scanLabels := append(labels, Label{"function", pool.Scan.Function}, Label{"state", pool.Scan.State})
+		set.add("zfs_pool_scan_progress_percent", "Progress of the last or running scrub or resilver.", path(poolPath, "scan", "percent"), pool.Scan.Percent, scanLabels...)
+		set.add("zfs_pool_scan_errors", "Errors found by the last scrub or resilver.", path(poolPath, "scan", "errors"), float64(pool.Scan.Errors), labels...)
+		for _, vdev := range pool.Vdevs {
+			vdevLabels := append(labels, Label{"vdev", vdev.Name})
+			vdevPath := path(poolPath, "vdevs", vdev.Name)
+			set.add("zfs_vdev_read_errors", "Read errors of the vdev.", path(vdevPath, "read_errors"), float64(vdev.ReadErrors), vdevLabels...)
+			set.add("zfs_vdev_write_errors", "Write errors of the vdev.", path(vdevPath, "write_errors"), float64(vdev.WriteErrors), vdevLabels...)
+			set.add("zfs_vdev_checksum_errors", "Checksum errors of the vdev.", path(vdevPath, "checksum_errors"), float64(vdev.ChecksumErrors), vdevLabels...)
+		}
+	}
+	if arc := report.Zfs.Arc; arc != nil {
+		arcToBytes := util.SizeConvertionFunction(units.Memory, util.BYTE)
+		set.add("zfs_arc_size_bytes", "Current size of the ZFS ARC.", []string{"zfs", "arc", "size"}, arcToBytes(arc.Size))
+		set.add("zfs_arc_target_size_bytes", "Target size of the ZFS ARC.", []string{"zfs", "arc", "target_size"}, arcToBytes(arc.TargetSize))
+		set.add("zfs_arc_max_size_bytes", "Maximum size of the ZFS ARC.", []string{"zfs", "arc", "max_size"}, arcToBytes(arc.MaxSize))
+		set.add("zfs_arc_hit_ratio_percent", "ZFS ARC hits as a percentage of all the lookups since boot.", []string{"zfs", "arc", "hit_ratio_percent"}, arc.HitRatioPercent)
+	}
+
+	mebiBytesToBytes := util.SizeConvertionFunction(util.MEBI, util.BYTE)
+	for _, network := range report.Network {
+		labels := []Label{{"interface", network.Iname}}
+		networkPath := []string{"network", network.Iname}
+		set.add("network_receive_bytes_per_second", "Bytes received per second.", path(networkPath, "rx_MiBs"), mebiBytesToBytes(network.RxMiBs), labels...)
+		set.add("network_transmit_bytes_per_second", "Bytes transmitted per second.", path(networkPath, "tx_MiBs"), mebiBytesToBytes(network.TxMiBs), labels...)
+	}
+
+	set.add("cpu_load_percent", "Load of the CPU as a percentage.", []string{"cpu", "load_percent"}, report.Cpu.LoadPercent)
+	set.add("cpu_temp_celsius", "Temperature of the CPU, 0 when unavailable.", []string{"cpu", "temp"}, float64(report.Cpu.Temp))
+	for _, core := range report.Cores {
+		set.add("core_load_percent", "Load of the CPU core as a percentage.", []string{"cores", core.Name, "load_percent"}, core.LoadPercent, Label{"core", core.Name})
+	}
+
+	memoryToBytes := util.SizeConvertionFunction(units.Memory, util.BYTE)
+	set.add("memory_total_bytes", "Total memory.", []string{"memory", "total"}, memoryToBytes(report.Memory.Total))
+	set.add("memory_used_bytes", "Used memory.", []string{"memory", "used"}, memoryToBytes(report.Memory.Used))
+	set.add("memory_free_bytes", "Available memory.", []string{"memory", "free"}, memoryToBytes(report.Memory.Free))
+	set.add("memory_used_percent", "Used memory as a percentage.", []string{"memory", "used_percent"}, report.Memory.UsedPercent)
+
+	for _, alert := range report.Alerts {
+		set.add("alert_firing", "Alerts currently firing, always 1.", []string{"alerts", alert.Name}, 1,
+			Label{"name", alert.Name}, Label{"severity", alert.Severity}, Label{"path", alert.Path})
+	}
+
+	metrics := make([]Metric, 0, len(set.metrics))
+	for _, metric := range set.metrics {
+		metrics = append(metrics, *metric)
+	}
+	return metrics
+}
+
+// FilterMetrics removes the samples whose path is not allowed by the filter,
+// the labels taken from paths it does not allow, e.g. array.*.disk_id, and the metrics left without samples.
+func FilterMetrics(metrics []Metric, filter Filter) []Metric {
+	if filter.IsEmpty() {
+		return metrics
+	}
+	filtered := make([]Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		samples := make([]Sample, 0, len(metric.Samples))
+		for _, sample := range metric.Samples {
+			if filter.Allows(sample.Path...) {
+				samples = append(samples, sample.allowedLabels(filter))
+			}
+		}
+		if len(samples) > 0 {
+			metric.Samples = samples
+			filtered = append(filtered, metric)
+		}
+	}
+	return filtered
+}
+
+func (sample Sample) allowedLabels(filter Filter) Sample {
+	labels := make([]Label, 0, len(sample.Labels))
+	for _, label := range sample.Labels {
+		if path, found := sample.labelPaths[label.Name]; !found || filter.Allows(path...) {
+			labels = append(labels, label)
+		}
+	}
+	sample.Labels = labels
+	return sample
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format.
+func WritePrometheus(w io.Writer, metrics []Metric) error {
+	buffer := bufio.NewWriter(w)
+
+	for _, metric := range metrics {
+		fmt.Fprintf(buffer, "# HELP %s %s\n", metric.Name, helpReplacer.Replace(metric.Help))
+		fmt.Fprintf(buffer, "# TYPE %s %s\n", metric.Name, metric.Type)
+		for _, sample := range metric.Samples {
+			buffer.WriteString(metric.Name)
+			if len(sample.Labels) > 0 {
+				buffer.WriteByte('{')
+				for i, label := range sample.Labels {
+					if i > 0 {
+						buffer.WriteByte(',')
+					}
+					fmt.Fprintf(buffer, `%s="%s"`, label.Name, labelValueReplacer.Replace(label.Value))
+				}
+				buffer.WriteByte('}')
+			}
+			buffer.WriteByte(' ')
+			buffer.WriteString(formatPrometheusValue(sample.Value))
+			buffer.WriteByte('\n')
+		}
+	}
+
+	return buffer.Flush()
+}
+
+func formatPrometheusValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+}
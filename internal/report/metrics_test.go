@@ -0,0 +1,74 @@
+package report
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	"github.com/NebN/unraid-simple-monitoring-api/internal/monitor"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	metrics := []Metric{
+		{
+			Name: "unraid_disk_temp_celsius",
+			Help: "Temperature of the disk.",
+			Type: gauge,
+			Samples: []Sample{
+				{Labels: []Label{{"mount", "/mnt/disk1"}, {"disk_id", `weird"id`}}, Value: 35},
+				{Labels: []Label{{"mount", "/mnt/disk2"}, {"disk_id", "id2"}}, Value: 0.5},
+			},
+		},
+		{
+			Name:    "unraid_cpu_load_percent",
+			Help:    "Load of the CPU.",
+			Type:    gauge,
+			Samples: []Sample{{Value: 12.25}},
+		},
+	}
+
+	expected := `# HELP unraid_disk_temp_celsius Temperature of the disk.
+# TYPE unraid_disk_temp_celsius gauge
+unraid_disk_temp_celsius{mount="/mnt/disk1",disk_id="weird\"id"} 35
+unraid_disk_temp_celsius{mount="/mnt/disk2",disk_id="id2"} 0.5
+# HELP unraid_cpu_load_percent Load of the CPU.
+# TYPE unraid_cpu_load_percent gauge
+unraid_cpu_load_percent 12.25
+`
+
+	var buffer bytes.Buffer
+	err := WritePrometheus(&buffer, metrics)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if buffer.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buffer.String())
+	}
+}
+
+func TestMetricsConvertsToBytes(t *testing.T) {
+	report := Report{
+		Array: []monitor.DiskStatus{{Path: "/mnt/disk1", Total: 2, Used: 1, Free: 1}},
+		Memory: monitor.MemoryStatus{
+			Total: 1,
+		},
+	}
+	units := conf.Units{Array: "Gi", Cache: "Gi", Pools: "Gi", Memory: "Mi"}
+
+	var buffer bytes.Buffer
+	WritePrometheus(&buffer, Metrics(report, units))
+	output := buffer.String()
+
+	expectedLines := []string{
+		`unraid_disk_total_bytes{pool="array",mount="/mnt/disk1",disk_id=""} 2147483648`,
+		`unraid_pool_total_bytes{pool="array"} 0`,
+		`unraid_memory_total_bytes 1048576`,
+	}
+
+	for _, line := range expectedLines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package report
+
+import (
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/monitor"
+)
+
+type Report struct {
+	Array        []monitor.DiskStatus      `json:"array"`
+	Cache        []monitor.DiskStatus      `json:"cache"`
+	Pools        []monitor.PoolStatus      `json:"pools"`
+	Parity       []monitor.ParityStatus    `json:"parity"`
+	ParityCheck  monitor.ParityCheckStatus `json:"parity_check"`
+	ArrayState   monitor.ArrayState        `json:"array_state"`
+	Zfs          monitor.ZfsStatus         `json:"zfs"`
+	Shares       []monitor.ShareStatus     `json:"shares"`
+	Network      []monitor.NetworkRate     `json:"network"`
+	ArrayTotal   monitor.DiskStatus        `json:"array_total"`
+	CacheTotal   monitor.DiskStatus        `json:"cache_total"`
+	CacheBtrfs   *monitor.BtrfsStatus      `json:"cache_btrfs,omitempty"`
+	NetworkTotal monitor.NetworkRate       `json:"network_total"`
+	Cpu          monitor.CpuStatus         `json:"cpu"`
+	Cores        []monitor.CoreStatus      `json:"cores"`
+	Memory       monitor.MemoryStatus      `json:"memory"`
+	Alerts       []Alert                   `json:"alerts"`
+	SampledAt    time.Time                 `json:"sampled_at"`
+	Error        *string                   `json:"error"`
+}
+
+func NewErrorReport(err string) (report Report) {
+
+	report.Array = make([]monitor.DiskStatus, 0)
+	report.Cache = make([]monitor.DiskStatus, 0)
+	report.Network = make([]monitor.NetworkRate, 0)
+
+	report.Error = &err
+
+	return
+}
+
+const arrayLabel = "array"
+const cacheLabel = "cache"
+
+// Pool returns the status of the named pool, the array and the cache included.
+func (report Report) Pool(name string) (monitor.PoolStatus, bool) {
+	switch name {
+	case arrayLabel:
+		return monitor.PoolStatus{Name: name, Total: report.ArrayTotal, Disks: report.Array}, report.Array != nil
+	case cacheLabel:
+		return monitor.PoolStatus{Name: name, Total: report.CacheTotal, Disks: report.Cache, Btrfs: report.CacheBtrfs}, report.Cache != nil
+	}
+	for _, pool := range report.Pools {
+		if pool.Name == name {
+			return pool, true
+		}
+	}
+	return monitor.PoolStatus{}, false
+}
+
+type CpuReport struct {
+	Cpu   monitor.CpuStatus    `json:"cpu"`
+	Cores []monitor.CoreStatus `json:"cores"`
+}
+
+type NetworkReport struct {
+	Network      []monitor.NetworkRate `json:"network"`
+	NetworkTotal monitor.NetworkRate   `json:"network_total"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
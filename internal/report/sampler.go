@@ -0,0 +1,118 @@
+package report
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Sampler runs the collector on a fixed interval and caches the resulting report,
+// so that rates always cover the same window regardless of how often clients poll.
+type Sampler struct {
+	collector *Collector
+	history   *History
+	interval  time.Duration
+	mu        sync.RWMutex
+	report    Report
+	ready     chan struct{}
+}
+
+func NewSampler(collector *Collector, history *History, interval time.Duration) *Sampler {
+	return &Sampler{
+		collector: collector,
+		history:   history,
+		interval:  interval,
+		ready:     make(chan struct{}),
+	}
+}
+
+// the first sample is taken this long after starting, or after one interval if shorter,
+// so that rates such as the CPU load cover more than the few milliseconds since the monitors were created
+const firstSampleDelay = time.Second
+
+// Run blocks until the context is cancelled.
+func (s *Sampler) Run(ctx context.Context) {
+	slog.Info("Sampling", slog.String("interval", s.interval.String()))
+	first := time.NewTimer(min(firstSampleDelay, s.interval))
+	defer first.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-first.C:
+		s.sample()
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sample()
+		}
+	}
+}
+
+func (s *Sampler) sample() {
+	start := time.Now()
+	report := s.collector.Collect()
+	report.SampledAt = start
+
+	s.mu.Lock()
+	s.report = report
+	s.mu.Unlock()
+
+	if s.history != nil {
+		s.history.Record(report)
+	}
+
+	select {
+	case <-s.ready:
+	default:
+		close(s.ready)
+	}
+
+	slog.Debug("Sample collected", "duration", time.Since(start))
+}
+
+// Report returns the latest sample, waiting for the first one if none has been taken yet,
+// unless the context is cancelled first.
+func (s *Sampler) Report(ctx context.Context) (Report, error) {
+	select {
+	case <-s.ready:
+	case <-ctx.Done():
+		return Report{}, ctx.Err()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.report, nil
+}
+
+// Latest returns the latest sample without waiting, false if none has been taken yet.
+func (s *Sampler) Latest() (Report, bool) {
+	select {
+	case <-s.ready:
+	default:
+		return Report{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.report, true
+}
+
+// Alerts returns the alerts engine, nil if no rule is configured
+func (s *Sampler) Alerts() *AlertEngine {
+	return s.collector.Alerts
+}
+
+// History returns the past samples, nil if they are not kept
+func (s *Sampler) History() *History {
+	return s.history
+}
+
+func (s *Sampler) Interval() time.Duration {
+	return s.interval
+}
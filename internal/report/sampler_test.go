@@ -0,0 +1,46 @@
+package report
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// nothing is measured, the collector only has to produce a report
+func testSampler(interval time.Duration) *Sampler {
+	return NewSampler(&Collector{Filter: NewFilter([]string{"nothing"}, nil)}, nil, interval)
+}
+
+func TestSamplerWaitsForFirstSample(t *testing.T) {
+	sampler := testSampler(time.Hour)
+
+	if _, ok := sampler.Latest(); ok {
+		t.Fatalf("expected no sample before running")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := sampler.Report(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to be cancelled, got %v", err)
+	}
+}
+
+func TestSamplerTakesFirstSampleEarly(t *testing.T) {
+	sampler := testSampler(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sampler.Run(ctx)
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer waitCancel()
+	sample, err := sampler.Report(waitCtx)
+	if err != nil {
+		t.Fatalf("expected the first sample well before the interval, got %v", err)
+	}
+	if sample.SampledAt.IsZero() {
+		t.Fatalf("expected the sample time to be set")
+	}
+	if latest, ok := sampler.Latest(); !ok || !latest.SampledAt.Equal(sample.SampledAt) {
+		t.Fatalf("expected the latest sample to be available without waiting")
+	}
+}
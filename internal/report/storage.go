@@ -0,0 +1,576 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	ExportCsv  = "csv"
+	ExportJson = "json"
+)
+
+// waiting this long for the database, it being locked by whoever has it open
+const storageOpenTimeout = 10 * time.Second
+
+// ErrStorageInUse is returned when another process, such as the running API, has the database open
+var ErrStorageInUse = errors.New("the database is in use by another process, such as the running API")
+
+// compaction rewrites the file once this share of it is free pages
+const storageCompactFreeRatio = 0.5
+
+// rewriting the file commits every this many bytes, bounding the memory it takes
+const storageCompactTxSize = 16 << 20
+
+// min, max, sum and count
+const storageValueSize = 4 * 8
+
+type storageTier struct {
+	resolution time.Duration
+	retention  time.Duration
+	// metric -> bucket being filled, written once the next one starts
+	pending map[string]historyBucket
+}
+
+// name is the bolt bucket holding the tier, e.g. "1m0s"
+func (tier *storageTier) name() []byte {
+	return []byte(tier.resolution.String())
+}
+
+// Storage persists the metrics to a bolt database, one bolt bucket per tier and metric, keyed by the start of each bucket.
+// Recording only aggregates in memory, the completed buckets being written and the database compacted by Run,
+// so that the sampler never waits for the disk.
+type Storage struct {
+	path            string
+	compactInterval time.Duration
+	mu              sync.Mutex
+	tiers           []*storageTier
+	// completed buckets not written yet
+	unwritten []storageWrite
+	// signals Run that there are buckets to write
+	completed chan struct{}
+	closed    bool
+
+	// held for writing while the database is replaced by its rewritten copy, or closed
+	dbMu sync.RWMutex
+	db   *bolt.DB
+}
+
+// NewStorage opens the database, which stays open until Close
+func NewStorage(storage conf.Storage) (*Storage, error) {
+	tiers := make([]*storageTier, 0, len(storage.Tiers))
+	for _, tier := range storage.Tiers {
+		if tier.Resolution < time.Second || tier.Retention < tier.Resolution {
+			slog.Warn("Storage ignoring tier, its resolution must be at least 1s and its retention at least its resolution",
+				"resolution", tier.Resolution, "retention", tier.Retention)
+			continue
+		}
+		tiers = append(tiers, &storageTier{
+			resolution: tier.Resolution,
+			retention:  tier.Retention,
+			pending:    make(map[string]historyBucket),
+		})
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].resolution < tiers[j].resolution })
+
+	for _, tier := range tiers {
+		slog.Info("Storage", "path", storage.Path, "resolution", tier.resolution, "retention", tier.retention)
+	}
+	db, err := openStorage(storage.Path, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{path: storage.Path, compactInterval: storage.CompactInterval, tiers: tiers, completed: make(chan struct{}, 1), db: db}, nil
+}
+
+func openStorage(path string, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: storageOpenTimeout, ReadOnly: readOnly})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, ErrStorageInUse
+	}
+	return db, err
+}
+
+func encodeStorageKey(start int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(start))
+	return key
+}
+
+func encodeStorageValue(bucket historyBucket) []byte {
+	value := make([]byte, storageValueSize)
+	binary.BigEndian.PutUint64(value[0:], math.Float64bits(bucket.min))
+	binary.BigEndian.PutUint64(value[8:], math.Float64bits(bucket.max))
+	binary.BigEndian.PutUint64(value[16:], math.Float64bits(bucket.sum))
+	binary.BigEndian.PutUint64(value[24:], uint64(bucket.count))
+	return value
+}
+
+func decodeStorageBucket(key []byte, value []byte) (historyBucket, bool) {
+	if len(key) != 8 || len(value) != storageValueSize {
+		return historyBucket{}, false
+	}
+	return historyBucket{
+		start: int64(binary.BigEndian.Uint64(key)),
+		min:   math.Float64frombits(binary.BigEndian.Uint64(value[0:])),
+		max:   math.Float64frombits(binary.BigEndian.Uint64(value[8:])),
+		sum:   math.Float64frombits(binary.BigEndian.Uint64(value[16:])),
+		count: int(binary.BigEndian.Uint64(value[24:])),
+	}, true
+}
+
+type storageWrite struct {
+	tier   []byte
+	metric string
+	bucket historyBucket
+}
+
+// Record aggregates the metrics into the pending buckets, handing the completed ones over to Run
+func (storage *Storage) Record(metrics []Metric, at time.Time) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.closed {
+		return
+	}
+
+	completed := false
+	for _, tier := range storage.tiers {
+		start := at.Truncate(tier.resolution).Unix()
+		for _, metric := range metrics {
+			for _, sample := range metric.Samples {
+				path := strings.Join(sample.Path, ".")
+				sampleBucket := historyBucket{start: start, min: sample.Value, max: sample.Value, sum: sample.Value, count: 1}
+				pending, exists := tier.pending[path]
+				if exists && pending.start == start {
+					pending.merge(sampleBucket)
+					tier.pending[path] = pending
+					continue
+				}
+				if exists {
+					storage.unwritten = append(storage.unwritten, storageWrite{tier: tier.name(), metric: path, bucket: pending})
+					completed = true
+				}
+				tier.pending[path] = sampleBucket
+			}
+		}
+	}
+
+	if completed {
+		select {
+		case storage.completed <- struct{}{}:
+		default:
+			// Run has yet to pick up the previous signal, it will write these as well
+		}
+	}
+}
+
+// Run writes the completed buckets as they come, and compacts the database on every compaction interval,
+// the first time right away so that whatever a previous run left behind is cleaned up. It returns once the context is cancelled.
+func (storage *Storage) Run(ctx context.Context) {
+	storage.compactAndLog(time.Now())
+	ticker := time.NewTicker(storage.compactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-storage.completed:
+			storage.writeUnwritten()
+		case <-ticker.C:
+			storage.compactAndLog(time.Now())
+		}
+	}
+}
+
+// Close writes the buckets still being filled, so that nothing is lost on restarts, and closes the database
+func (storage *Storage) Close() error {
+	storage.mu.Lock()
+	if storage.closed {
+		storage.mu.Unlock()
+		return nil
+	}
+	storage.closed = true
+	for _, tier := range storage.tiers {
+		for path, pending := range tier.pending {
+			storage.unwritten = append(storage.unwritten, storageWrite{tier: tier.name(), metric: path, bucket: pending})
+		}
+		tier.pending = make(map[string]historyBucket)
+	}
+	storage.mu.Unlock()
+
+	storage.writeUnwritten()
+
+	storage.dbMu.Lock()
+	defer storage.dbMu.Unlock()
+	if storage.db == nil {
+		return nil
+	}
+	err := storage.db.Close()
+	slog.Info("Storage closed", "path", storage.path)
+	return err
+}
+
+func (storage *Storage) writeUnwritten() {
+	storage.mu.Lock()
+	writes := storage.unwritten
+	storage.unwritten = nil
+	storage.mu.Unlock()
+	if len(writes) == 0 {
+		return
+	}
+
+	if err := storage.write(writes); err != nil {
+		slog.Error("Storage unable to write", slog.String("path", storage.path), slog.String("error", err.Error()))
+		return
+	}
+	slog.Debug("Storage written", "buckets", len(writes))
+}
+
+func (storage *Storage) write(writes []storageWrite) error {
+	storage.dbMu.RLock()
+	defer storage.dbMu.RUnlock()
+	if storage.db == nil {
+		return bolt.ErrDatabaseNotOpen
+	}
+
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		for _, write := range writes {
+			tierBucket, err := tx.CreateBucketIfNotExists(write.tier)
+			if err != nil {
+				return err
+			}
+			metricBucket, err := tierBucket.CreateBucketIfNotExists([]byte(write.metric))
+			if err != nil {
+				return err
+			}
+			// a bucket already written by a previous run is merged rather than overwritten
+			if existing, ok := decodeStorageBucket(encodeStorageKey(write.bucket.start), metricBucket.Get(encodeStorageKey(write.bucket.start))); ok {
+				write.bucket.merge(existing)
+			}
+			if err := metricBucket.Put(encodeStorageKey(write.bucket.start), encodeStorageValue(write.bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (storage *Storage) compactAndLog(now time.Time) {
+	if err := storage.compact(now); err != nil {
+		slog.Error("Storage unable to compact", slog.String("path", storage.path), slog.String("error", err.Error()))
+	}
+}
+
+// compact drops the buckets past their tier's retention and the tiers no longer configured,
+// then rewrites the file if too much of it has become free space.
+func (storage *Storage) compact(now time.Time) error {
+	start := time.Now()
+	storage.dbMu.RLock()
+	db := storage.db
+	if db == nil {
+		storage.dbMu.RUnlock()
+		return bolt.ErrDatabaseNotOpen
+	}
+
+	retentions := make(map[string]time.Duration, len(storage.tiers))
+	for _, tier := range storage.tiers {
+		retentions[string(tier.name())] = tier.retention
+	}
+
+	deleted := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		tierNames := make([][]byte, 0)
+		tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			tierNames = append(tierNames, append([]byte{}, name...))
+			return nil
+		})
+
+		for _, tierName := range tierNames {
+			retention, configured := retentions[string(tierName)]
+			if !configured {
+				slog.Info("Storage deleting tier no longer configured", "tier", string(tierName))
+				if err := tx.DeleteBucket(tierName); err != nil {
+					return err
+				}
+				continue
+			}
+
+			cutoff := encodeStorageKey(now.Add(-retention).Unix())
+			tierBucket := tx.Bucket(tierName)
+			emptied := make([][]byte, 0)
+			err := tierBucket.ForEachBucket(func(metric []byte) error {
+				metricBucket := tierBucket.Bucket(metric)
+				cursor := metricBucket.Cursor()
+				for key, _ := cursor.First(); key != nil && bytes.Compare(key, cutoff) < 0; key, _ = cursor.First() {
+					if err := cursor.Delete(); err != nil {
+						return err
+					}
+					deleted++
+				}
+				if key, _ := cursor.First(); key == nil {
+					emptied = append(emptied, append([]byte{}, metric...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, metric := range emptied {
+				if err := tierBucket.DeleteBucket(metric); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		storage.dbMu.RUnlock()
+		return err
+	}
+
+	info, statErr := os.Stat(storage.path)
+	freeBytes := int64(db.Stats().FreePageN) * int64(db.Info().PageSize)
+	rewrite := statErr == nil && info.Size() > 0 && float64(freeBytes)/float64(info.Size()) >= storageCompactFreeRatio
+	storage.dbMu.RUnlock()
+	if !rewrite {
+		slog.Debug("Storage compacted", "deleted", deleted, "duration", time.Since(start))
+		return nil
+	}
+
+	// the writes and queries wait for the rewritten copy to replace the database, the recording does not
+	storage.dbMu.Lock()
+	defer storage.dbMu.Unlock()
+	temporary := storage.path + ".compact"
+	os.Remove(temporary)
+	compacted, err := bolt.Open(temporary, 0644, &bolt.Options{Timeout: storageOpenTimeout})
+	if err != nil {
+		return err
+	}
+	err = bolt.Compact(compacted, storage.db, storageCompactTxSize)
+	compacted.Close()
+	if err != nil {
+		os.Remove(temporary)
+		return err
+	}
+	if err := storage.db.Close(); err != nil {
+		return err
+	}
+	renameErr := os.Rename(temporary, storage.path)
+	// reopened either way, the previous file being kept if it could not be replaced
+	storage.db, err = openStorage(storage.path, false)
+	if err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	slog.Info("Storage compacted and rewritten", "deleted", deleted, "duration", time.Since(start))
+	return nil
+}
+
+// Query aggregates the stored points of the metric like History.Query, using the finest tier still holding from
+func (storage *Storage) Query(metric string, from time.Time, to time.Time, step time.Duration, now time.Time) (HistoryResult, error) {
+	if len(storage.tiers) == 0 {
+		return HistoryResult{}, ErrUnknownMetric
+	}
+	tier := storage.tiers[len(storage.tiers)-1]
+	for _, candidate := range storage.tiers {
+		if now.Sub(from) <= candidate.retention {
+			tier = candidate
+			break
+		}
+	}
+
+	// the buckets not written yet, oldest first
+	storage.mu.Lock()
+	recent := make([]historyBucket, 0)
+	for _, write := range storage.unwritten {
+		if write.metric == metric && bytes.Equal(write.tier, tier.name()) {
+			recent = append(recent, write.bucket)
+		}
+	}
+	if pending, exists := tier.pending[metric]; exists {
+		recent = append(recent, pending)
+	}
+	storage.mu.Unlock()
+
+	buckets := make([]historyBucket, 0)
+	storage.dbMu.RLock()
+	err := bolt.ErrDatabaseNotOpen
+	if storage.db != nil {
+		err = storage.db.View(func(tx *bolt.Tx) error {
+			tierBucket := tx.Bucket(tier.name())
+			if tierBucket == nil {
+				return nil
+			}
+			metricBucket := tierBucket.Bucket([]byte(metric))
+			if metricBucket == nil {
+				return nil
+			}
+			cursor := metricBucket.Cursor()
+			last := encodeStorageKey(to.Unix())
+			for key, value := cursor.Seek(encodeStorageKey(from.Truncate(tier.resolution).Unix())); key != nil && bytes.Compare(key, last) <= 0; key, value = cursor.Next() {
+				if bucket, ok := decodeStorageBucket(key, value); ok {
+					buckets = append(buckets, bucket)
+				}
+			}
+			return nil
+		})
+	}
+	storage.dbMu.RUnlock()
+	if err != nil {
+		slog.Debug("Storage unable to read", "path", storage.path, "error", err.Error())
+	}
+
+	if len(buckets) == 0 && len(recent) == 0 {
+		return HistoryResult{}, ErrUnknownMetric
+	}
+	for _, bucket := range recent {
+		if len(buckets) > 0 && buckets[len(buckets)-1].start == bucket.start {
+			buckets[len(buckets)-1].merge(bucket)
+		} else {
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	step = max(step, tier.resolution)
+	each := func(f func(historyBucket)) {
+		for _, bucket := range buckets {
+			f(bucket)
+		}
+	}
+	return HistoryResult{
+		Metric:      metric,
+		From:        from,
+		To:          to,
+		StepSeconds: step.Seconds(),
+		Points:      aggregateBuckets(each, from, to, tier.resolution, step),
+	}, nil
+}
+
+type ExportedSeries struct {
+	Metric            string         `json:"metric"`
+	ResolutionSeconds float64        `json:"resolution_seconds"`
+	Points            []HistoryPoint `json:"points"`
+}
+
+// Export writes every series stored in the database at path as CSV or JSON, optionally only the given metric
+// and points between from and to. The database cannot be open in another process, see Storage.Export.
+func Export(w io.Writer, path string, format string, metric string, from time.Time, to time.Time) error {
+	if err := checkExportFormat(format); err != nil {
+		return err
+	}
+	db, err := openStorage(path, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	series, err := readSeries(db, metric, from, to, NewFilter(nil, nil))
+	if err != nil {
+		return err
+	}
+	return writeSeries(w, format, series)
+}
+
+// Export writes the stored series like Export, from the open database and only those the filter allows
+func (storage *Storage) Export(w io.Writer, format string, metric string, from time.Time, to time.Time, filter Filter) error {
+	if err := checkExportFormat(format); err != nil {
+		return err
+	}
+	storage.dbMu.RLock()
+	if storage.db == nil {
+		storage.dbMu.RUnlock()
+		return bolt.ErrDatabaseNotOpen
+	}
+	series, err := readSeries(storage.db, metric, from, to, filter)
+	storage.dbMu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return writeSeries(w, format, series)
+}
+
+func checkExportFormat(format string) error {
+	if format != ExportCsv && format != ExportJson {
+		return fmt.Errorf("unknown format %s, expected %s or %s", format, ExportCsv, ExportJson)
+	}
+	return nil
+}
+
+func readSeries(db *bolt.DB, metric string, from time.Time, to time.Time, filter Filter) ([]ExportedSeries, error) {
+	series := make([]ExportedSeries, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(tierName []byte, tierBucket *bolt.Bucket) error {
+			resolution, err := time.ParseDuration(string(tierName))
+			if err != nil {
+				return nil
+			}
+			return tierBucket.ForEachBucket(func(metricName []byte) error {
+				if (metric != "" && metric != string(metricName)) || !filter.Allows(strings.Split(string(metricName), ".")...) {
+					return nil
+				}
+				exported := ExportedSeries{Metric: string(metricName), ResolutionSeconds: resolution.Seconds(), Points: make([]HistoryPoint, 0)}
+				tierBucket.Bucket(metricName).ForEach(func(key []byte, value []byte) error {
+					bucket, ok := decodeStorageBucket(key, value)
+					at := time.Unix(bucket.start, 0)
+					if ok && !at.Before(from) && !at.After(to) {
+						exported.Points = append(exported.Points, HistoryPoint{
+							Timestamp: at,
+							Min:       bucket.min,
+							Max:       bucket.max,
+							Avg:       bucket.sum / float64(bucket.count),
+						})
+					}
+					return nil
+				})
+				series = append(series, exported)
+				return nil
+			})
+		})
+	})
+	return series, err
+}
+
+func writeSeries(w io.Writer, format string, series []ExportedSeries) error {
+	if format == ExportJson {
+		return json.NewEncoder(w).Encode(series)
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"metric", "resolution_seconds", "timestamp", "min", "max", "avg"})
+	formatFloat := func(value float64) string {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	for _, exported := range series {
+		for _, point := range exported.Points {
+			writer.Write([]string{
+				exported.Metric,
+				formatFloat(exported.ResolutionSeconds),
+				point.Timestamp.UTC().Format(time.RFC3339),
+				formatFloat(point.Min),
+				formatFloat(point.Max),
+				formatFloat(point.Avg),
+			})
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,112 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/conf"
+)
+
+func TestStorage(t *testing.T) {
+	configuration := conf.Storage{
+		Path:            filepath.Join(t.TempDir(), "metrics.db"),
+		CompactInterval: time.Hour,
+		Tiers:           []conf.HistoryTier{{Resolution: time.Minute, Retention: time.Hour}},
+	}
+	load := func(value float64) []Metric {
+		return []Metric{{Name: "unraid_cpu_load_percent", Samples: []Sample{{Path: []string{"cpu", "load_percent"}, Value: value}}}}
+	}
+
+	start := time.Unix(1700000000, 0).Truncate(time.Minute)
+	storage, err := NewStorage(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go storage.Run(ctx)
+	// 10 and 20 in the first minute, written by Run once the second starts
+	storage.Record(load(10), start)
+	storage.Record(load(20), start.Add(30*time.Second))
+	storage.Record(load(30), start.Add(time.Minute))
+
+	firstMinute := "cpu.load_percent,60," + start.UTC().Format(time.RFC3339) + ",10,20,15\n"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var written bytes.Buffer
+		if err := storage.Export(&written, ExportCsv, "", time.Unix(0, 0), start.Add(time.Hour), NewFilter(nil, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(written.String(), firstMinute) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the first minute to be written, got:\n%s", written.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the second minute is still pending, closing writes it rather than losing it
+	cancel()
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewStorage(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := restarted.Query("cpu.load_percent", start, start.Add(2*time.Minute), 0, start.Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []HistoryPoint{
+		{Timestamp: start, Min: 10, Max: 20, Avg: 15},
+		{Timestamp: start.Add(time.Minute), Min: 30, Max: 30, Avg: 30},
+	}
+	if !reflect.DeepEqual(result.Points, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, result.Points)
+	}
+
+	var filtered bytes.Buffer
+	if err := restarted.Export(&filtered, ExportCsv, "", time.Unix(0, 0), start.Add(time.Hour), NewFilter(nil, []string{"cpu"})); err != nil {
+		t.Fatal(err)
+	}
+	if filtered.String() != "metric,resolution_seconds,timestamp,min,max,avg\n" {
+		t.Fatalf("expected the excluded metric to be left out, got:\n%s", filtered.String())
+	}
+	if err := restarted.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	if err := Export(&buffer, configuration.Path, ExportCsv, "", time.Unix(0, 0), start.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	expectedCsv := "metric,resolution_seconds,timestamp,min,max,avg\n" + firstMinute +
+		"cpu.load_percent,60," + start.Add(time.Minute).UTC().Format(time.RFC3339) + ",30,30,30\n"
+	if buffer.String() != expectedCsv {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expectedCsv, buffer.String())
+	}
+
+	restarted, err = NewStorage(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	// past the retention, the compaction drops the point
+	if err := restarted.compact(start.Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.Query("cpu.load_percent", start, start.Add(time.Hour), 0, start.Add(time.Hour)); err != ErrUnknownMetric {
+		t.Fatalf("expected the metric to be gone, got %v", err)
+	}
+
+	if err := Export(&buffer, configuration.Path, "xml", "", start, start); err == nil || !strings.Contains(err.Error(), "unknown format") {
+		t.Fatalf("expected an unknown format error, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/monitor"
+)
+
+const (
+	SubsystemCpu         = "cpu"
+	SubsystemMemory      = "memory"
+	SubsystemNetwork     = "network"
+	SubsystemDisks       = "disks"
+	SubsystemParity      = "parity"
+	SubsystemParityCheck = "parity_check"
+	SubsystemZfs         = "zfs"
+	SubsystemShares      = "shares"
+	SubsystemAlerts      = "alerts"
+)
+
+var Subsystems = []string{SubsystemCpu, SubsystemMemory, SubsystemNetwork, SubsystemDisks, SubsystemParity, SubsystemParityCheck, SubsystemZfs, SubsystemShares, SubsystemAlerts}
+
+type DisksReport struct {
+	Array      []monitor.DiskStatus `json:"array"`
+	Cache      []monitor.DiskStatus `json:"cache"`
+	Pools      []monitor.PoolStatus `json:"pools"`
+	ArrayTotal monitor.DiskStatus   `json:"array_total"`
+	CacheTotal monitor.DiskStatus   `json:"cache_total"`
+	CacheBtrfs *monitor.BtrfsStatus `json:"cache_btrfs,omitempty"`
+	ArrayState monitor.ArrayState   `json:"array_state"`
+}
+
+// Subsystem returns the part of the report belonging to the named subsystem.
+func (report Report) Subsystem(name string) (any, error) {
+	switch name {
+	case SubsystemCpu:
+		return CpuReport{Cpu: report.Cpu, Cores: report.Cores}, nil
+	case SubsystemMemory:
+		return report.Memory, nil
+	case SubsystemNetwork:
+		return NetworkReport{Network: report.Network, NetworkTotal: report.NetworkTotal}, nil
+	case SubsystemDisks:
+		return DisksReport{
+			Array:      report.Array,
+			Cache:      report.Cache,
+			Pools:      report.Pools,
+			ArrayTotal: report.ArrayTotal,
+			CacheTotal: report.CacheTotal,
+			CacheBtrfs: report.CacheBtrfs,
+			ArrayState: report.ArrayState,
+		}, nil
+	case SubsystemParity:
+		return report.Parity, nil
+	case SubsystemParityCheck:
+		return report.ParityCheck, nil
+	case SubsystemZfs:
+		return report.Zfs, nil
+	case SubsystemShares:
+		return report.Shares, nil
+	case SubsystemAlerts:
+		return report.Alerts, nil
+	}
+	return nil, fmt.Errorf("unknown subsystem %s, accepted values are %v", name, Subsystems)
+}
+
+// FilteredSubsystem returns the named subsystem without the parts excluded by the filter.
+func (report Report) FilteredSubsystem(name string, filter Filter) (any, error) {
+	subsystem, err := report.Subsystem(name)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case SubsystemMemory, SubsystemParity, SubsystemParityCheck, SubsystemZfs, SubsystemShares, SubsystemAlerts:
+		// these are served as they appear in the report, under their own name
+		return filter.Apply(subsystem, name)
+	}
+	return filter.Apply(subsystem)
+}
+
+// Delta keeps track of the subsystems last sent to a client,
+// so that only the ones that changed since then are sent again.
+type Delta struct {
+	previous map[string]json.RawMessage
+}
+
+func NewDelta() *Delta {
+	return &Delta{previous: make(map[string]json.RawMessage)}
+}
+
+// Changed returns the marshalled subsystems that differ from the previous call,
+// an empty map means nothing changed.
+func (delta *Delta) Changed(report Report, subsystems []string, filter Filter) (map[string]json.RawMessage, error) {
+	changed := make(map[string]json.RawMessage)
+	for _, name := range subsystems {
+		subsystem, err := report.FilteredSubsystem(name, filter)
+		if err != nil {
+			return nil, err
+		}
+		marshalled, err := json.Marshal(subsystem)
+		if err != nil {
+			return nil, err
+		}
+		if string(delta.previous[name]) != string(marshalled) {
+			changed[name] = marshalled
+			delta.previous[name] = marshalled
+		}
+	}
+	return changed, nil
+}
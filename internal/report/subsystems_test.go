@@ -0,0 +1,42 @@
+package report
+
+import (
+	"testing"
+
+	"github.com/NebN/unraid-simple-monitoring-api/internal/monitor"
+)
+
+func TestDeltaChanged(t *testing.T) {
+	delta := NewDelta()
+	subsystems := []string{SubsystemCpu, SubsystemMemory}
+	sample := Report{Cpu: monitor.CpuStatus{LoadPercent: 10}, Memory: monitor.MemoryStatus{Used: 100}}
+
+	changed, err := delta.Changed(sample, subsystems, Filter{})
+	if err != nil || len(changed) != 2 {
+		t.Fatalf("expected every subsystem the first time, got %v %v", changed, err)
+	}
+
+	changed, err = delta.Changed(sample, subsystems, Filter{})
+	if err != nil || len(changed) != 0 {
+		t.Fatalf("expected nothing when nothing changed, got %v %v", changed, err)
+	}
+
+	sample.Memory.Used = 200
+	changed, err = delta.Changed(sample, subsystems, Filter{})
+	if err != nil || len(changed) != 1 || string(changed[SubsystemMemory]) == "" {
+		t.Fatalf("expected only memory to have changed, got %v %v", changed, err)
+	}
+
+	// a change to an excluded part is not a change
+	filter := NewFilter(nil, []string{"cpu.temp"})
+	filtered := NewDelta()
+	filtered.Changed(sample, subsystems, filter)
+	sample.Cpu.Temp = 50
+	if changed, _ := filtered.Changed(sample, subsystems, filter); len(changed) != 0 {
+		t.Fatalf("expected the excluded temperature change to be ignored, got %v", changed)
+	}
+
+	if _, err := delta.Changed(sample, []string{"gpu"}, Filter{}); err == nil {
+		t.Fatalf("expected an unknown subsystem to be rejected")
+	}
+}